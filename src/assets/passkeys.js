@@ -0,0 +1,93 @@
+// Passkey registration and login. The server speaks base64url where the
+// WebAuthn browser API wants ArrayBuffers, so values are converted both
+// ways here.
+
+function toBuffer(base64url) {
+  const base64 = base64url.replace(/-/g, "+").replace(/_/g, "/");
+  const padded = base64.padEnd(base64.length + ((4 - (base64.length % 4)) % 4), "=");
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+}
+
+function toBase64url(buffer) {
+  const bytes = String.fromCharCode(...new Uint8Array(buffer));
+  return btoa(bytes).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function withBuffers(credentials) {
+  return (credentials || []).map((c) => ({ ...c, id: toBuffer(c.id) }));
+}
+
+async function post(form, url, body) {
+  const response = await fetch(url, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": form.elements.csrf_token.value,
+    },
+    body: body && JSON.stringify(body),
+  });
+  if (!response.ok) {
+    throw new Error(`The server said: ${response.status} ${response.statusText}`);
+  }
+  return response.json();
+}
+
+async function register(form) {
+  const { publicKey } = await post(form, "/passkeys/register/begin");
+  publicKey.challenge = toBuffer(publicKey.challenge);
+  publicKey.user.id = toBuffer(publicKey.user.id);
+  publicKey.excludeCredentials = withBuffers(publicKey.excludeCredentials);
+
+  const credential = await navigator.credentials.create({ publicKey });
+  const name = encodeURIComponent(form.elements.name.value);
+  return post(form, `/passkeys/register/finish?name=${name}`, {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      attestationObject: toBase64url(credential.response.attestationObject),
+      transports: credential.response.getTransports?.() || [],
+    },
+  });
+}
+
+async function login(form) {
+  const { publicKey } = await post(form, "/passkeys/login/begin");
+  publicKey.challenge = toBuffer(publicKey.challenge);
+  publicKey.allowCredentials = withBuffers(publicKey.allowCredentials);
+
+  const credential = await navigator.credentials.get({ publicKey });
+  const remember = document.getElementById("remember")?.checked ? "on" : "";
+  return post(form, `/passkeys/login/finish?remember=${remember}`, {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      authenticatorData: toBase64url(credential.response.authenticatorData),
+      signature: toBase64url(credential.response.signature),
+      userHandle: credential.response.userHandle && toBase64url(credential.response.userHandle),
+    },
+  });
+}
+
+const ceremonies = { register, login };
+
+for (const form of document.querySelectorAll("form[data-passkey]")) {
+  if (!window.PublicKeyCredential) {
+    form.hidden = true;
+    continue;
+  }
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    const error = form.querySelector("[data-passkey-error]");
+    error.textContent = "";
+    try {
+      const { redirect } = await ceremonies[form.dataset.passkey](form);
+      window.location.assign(redirect);
+    } catch (e) {
+      error.textContent = `That didn't work. ${e.message}`;
+    }
+  });
+}
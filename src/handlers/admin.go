@@ -2,16 +2,28 @@ package handlers
 
 import (
 	"encoding/json"
-	"log/slog"
 	"net/http"
+	"slices"
 
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
 	"github.com/erkannt/rechenschaftspflicht/services/userstore"
 	"github.com/julienschmidt/httprouter"
 )
 
 type addUserRequest struct {
-	Email    string `json:"email"`
-	Username string `json:"username"`
+	Email    string   `json:"email"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+func knownRoles(roles []string) bool {
+	for _, role := range roles {
+		if !slices.Contains(userstore.KnownRoles, role) {
+			return false
+		}
+	}
+	return true
 }
 
 func AddUserHandler(userStore userstore.UserStore) httprouter.Handle {
@@ -22,14 +34,14 @@ func AddUserHandler(userStore userstore.UserStore) httprouter.Handle {
 			return
 		}
 
-		if req.Email == "" || req.Username == "" {
+		if req.Email == "" || req.Username == "" || !knownRoles(req.Roles) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		exists, err := userStore.IsUser(req.Email)
+		exists, err := userStore.IsUser(r.Context(), req.Email)
 		if err != nil {
-			slog.Error("failed to check if user exists", "error", err)
+			logging.FromContext(r.Context()).Error("failed to check if user exists", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -38,12 +50,113 @@ func AddUserHandler(userStore userstore.UserStore) httprouter.Handle {
 			return
 		}
 
-		if err := userStore.AddUser(req.Email, req.Username); err != nil {
-			slog.Error("failed to add user", "error", err)
+		if err := userStore.AddUser(r.Context(), req.Email, req.Username); err != nil {
+			logging.FromContext(r.Context()).Error("failed to add user", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		if len(req.Roles) > 0 {
+			if err := userStore.SetRoles(r.Context(), req.Email, req.Roles); err != nil {
+				logging.FromContext(r.Context()).Error("failed to set roles", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		logging.FromContext(r.Context()).Info("added user", "email", req.Email, "username", req.Username, "roles", req.Roles)
 
 		w.WriteHeader(http.StatusCreated)
 	}
 }
+
+type setRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// SetRolesHandler replaces the roles of the user named in the path.
+func SetRolesHandler(userStore userstore.UserStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		email := ps.ByName("email")
+		var req setRolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !knownRoles(req.Roles) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		exists, err := userStore.IsUser(r.Context(), email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to check if user exists", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := userStore.SetRoles(r.Context(), email, req.Roles); err != nil {
+			logging.FromContext(r.Context()).Error("failed to set roles", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("set user roles", "email", email, "roles", req.Roles)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type createAPITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type createAPITokenResponse struct {
+	Token string `json:"token"`
+}
+
+func CreateAPITokenHandler(apiTokens apitokens.APITokenStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var req createAPITokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.Name == "" || len(req.Scopes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !slices.Contains(apitokens.KnownScopes, scope) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, err := apiTokens.Create(req.Name, req.Scopes)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to create api token", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		logging.FromContext(r.Context()).Info("created api token", "api_token", req.Name, "scopes", req.Scopes)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(createAPITokenResponse{Token: token})
+	}
+}
+
+func RevokeAPITokenHandler(apiTokens apitokens.APITokenStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		name := ps.ByName("name")
+		if err := apiTokens.Revoke(name); err != nil {
+			logging.FromContext(r.Context()).Error("failed to revoke api token", "api_token", name, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("revoked api token", "api_token", name)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/julienschmidt/httprouter"
+)
+
+func sendJSON(h httprouter.Handle, method, path, body string, ps httprouter.Params) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r, ps)
+	return w.Code
+}
+
+func roles(t *testing.T, users userstore.UserStore, email string) []string {
+	t.Helper()
+	roles, err := users.Roles(context.Background(), email)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return roles
+}
+
+func TestAddUserHandler(t *testing.T) {
+	e := newTestEnv(t)
+	h := AddUserHandler(e.users)
+
+	cases := map[string]int{
+		`{"email":"jane@example.com","username":"jane","roles":["admin"]}`: http.StatusCreated,
+		`{"email":"joe@example.com","username":"joe"}`:                     http.StatusCreated,
+		`{"email":"JANE@example.com","username":"jane2"}`:                  http.StatusConflict,
+		`{"email":"max@example.com","username":"max","roles":["root"]}`:    http.StatusBadRequest,
+		`{"email":"","username":"nobody"}`:                                 http.StatusBadRequest,
+		`not json`:                                                         http.StatusBadRequest,
+	}
+	for body, want := range cases {
+		if got := sendJSON(h, http.MethodPost, "/add-user", body, nil); got != want {
+			t.Errorf("%s: expected %d, got %d", body, want, got)
+		}
+	}
+
+	if got := roles(t, e.users, "jane@example.com"); !slices.Equal(got, []string{userstore.RoleAdmin}) {
+		t.Errorf("expected jane to be admin, got %v", got)
+	}
+	if got := roles(t, e.users, "joe@example.com"); len(got) != 0 {
+		t.Errorf("expected joe to have no roles, got %v", got)
+	}
+	if exists, _ := e.users.IsUser(context.Background(), "max@example.com"); exists {
+		t.Error("expected user with an unknown role not to be added")
+	}
+}
+
+func TestSetRolesHandler(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "jane@example.com")
+	h := SetRolesHandler(e.users)
+	jane := httprouter.Params{{Key: "email", Value: "jane@example.com"}}
+
+	if got := sendJSON(h, http.MethodPut, "/users/jane@example.com/roles", `{"roles":["admin"]}`, jane); got != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, got)
+	}
+	if got := roles(t, e.users, "jane@example.com"); !slices.Equal(got, []string{userstore.RoleAdmin}) {
+		t.Errorf("expected jane to be admin, got %v", got)
+	}
+
+	if got := sendJSON(h, http.MethodPut, "/users/jane@example.com/roles", `{"roles":["root"]}`, jane); got != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown role, got %d", http.StatusBadRequest, got)
+	}
+	if got := roles(t, e.users, "jane@example.com"); !slices.Equal(got, []string{userstore.RoleAdmin}) {
+		t.Errorf("expected roles to be unchanged, got %v", got)
+	}
+
+	if got := sendJSON(h, http.MethodPut, "/users/jane@example.com/roles", `{"roles":[]}`, jane); got != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, got)
+	}
+	if got := roles(t, e.users, "jane@example.com"); len(got) != 0 {
+		t.Errorf("expected roles to be cleared, got %v", got)
+	}
+
+	nobody := httprouter.Params{{Key: "email", Value: "nobody@example.com"}}
+	if got := sendJSON(h, http.MethodPut, "/users/nobody@example.com/roles", `{"roles":["admin"]}`, nobody); got != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown user, got %d", http.StatusNotFound, got)
+	}
+}
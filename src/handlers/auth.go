@@ -1,113 +1,305 @@
 package handlers
 
 import (
-	"log"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/magiclinks"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/requestid"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
 	"github.com/erkannt/rechenschaftspflicht/services/userstore"
 	"github.com/erkannt/rechenschaftspflicht/views"
 	"github.com/julienschmidt/httprouter"
 )
 
-func LandingHandler(auth authentication.Auth) httprouter.Handle {
+// LandingHandler shows the login page, offering to log in with the
+// identity provider called ssoName unless it is empty.
+func LandingHandler(auth authentication.Auth, ssoName string) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		if auth.IsLoggedIn(r) {
-			cookie, _ := r.Cookie("auth")
-			email, _ := auth.ValidateToken(cookie.Value)
-			log.Printf("User %s already logged in, redirecting to /record-event", email)
+		if email, err := auth.GetLoggedInUserEmail(r); err == nil {
+			logging.FromContext(r.Context()).Debug("already logged in, redirecting to /record-event", "user", email)
 			http.Redirect(w, r, "/record-event", http.StatusFound)
 			return
 		}
-		err := views.LayoutBare(views.Login()).Render(r.Context(), w)
+		err := views.LayoutBare(views.Login(ssoName)).Render(r.Context(), w)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error rendering layout: %v", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 			return
 		}
 	}
 }
 
-func LoginPostHandler(userStore userstore.UserStore, auth authentication.Auth) httprouter.Handle {
+// LoginPostHandler emails a magic link and login code to known users, and
+// binds the code to the requesting browser. Every other request gets a
+// decoy binding instead, so the response doesn't tell whether the email
+// belongs to a user. With invalidateOlderLinks, links sent earlier to the
+// same user stop working. Users with maxOutstandingLinks unused links get
+// no more until they use one or they expire; zero means no cap.
+func LoginPostHandler(userStore userstore.UserStore, magicLinks magiclinks.MagicLinkStore, auth authentication.Auth, m *metrics.Metrics, invalidateOlderLinks bool, maxOutstandingLinks int) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		if err := r.ParseForm(); err != nil {
-			log.Printf("error parsing form: %v", err)
+		logger := logging.FromContext(r.Context())
+		checkYourEmail := func() {
+			cookie, err := auth.DecoyLoginCode()
+			if err != nil {
+				logger.Error("failed to create decoy login code cookie", "error", err)
+			} else {
+				http.SetCookie(w, &cookie)
+			}
 			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+		}
+
+		if err := r.ParseForm(); err != nil {
+			m.LoginAttempts.WithLabelValues("request", "invalid").Inc()
+			logger.Warn("failed to parse login form", "error", err)
+			checkYourEmail()
 			return
 		}
 
 		email := r.FormValue("email")
 		if email == "" {
-			log.Println("email required")
-			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+			m.LoginAttempts.WithLabelValues("request", "invalid").Inc()
+			logger.Warn("login requested without email")
+			checkYourEmail()
 			return
 		}
 
-		exists, err := userStore.IsUser(email)
+		exists, err := userStore.IsUser(r.Context(), email)
 		if err != nil {
-			log.Printf("error checking user %s: %v", email, err)
-			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+			m.LoginAttempts.WithLabelValues("request", "error").Inc()
+			logger.Error("failed to check if user exists", "email", email, "error", err)
+			checkYourEmail()
 			return
 		}
 		if !exists {
-			log.Printf("unauthorized email attempt: %s", email)
-			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+			m.LoginAttempts.WithLabelValues("request", "unknown_user").Inc()
+			logger.Warn("login requested for unknown email", "email", email)
+			checkYourEmail()
 			return
 		}
 
-		token, err := auth.GenerateToken(email)
+		if maxOutstandingLinks > 0 {
+			outstanding, err := magicLinks.Outstanding(r.Context(), email)
+			if err != nil {
+				m.LoginAttempts.WithLabelValues("request", "error").Inc()
+				logger.Error("failed to count outstanding magic links", "email", email, "error", err)
+				checkYourEmail()
+				return
+			}
+			if outstanding >= maxOutstandingLinks {
+				m.LoginAttempts.WithLabelValues("request", "capped").Inc()
+				logger.Warn("too many outstanding magic links", "security_event", "magic_link_cap", "email", email, "outstanding", outstanding)
+				checkYourEmail()
+				return
+			}
+		}
+
+		remember := r.FormValue("remember") == "on"
+		token, claims, err := auth.GenerateToken(email, remember)
 		if err != nil {
-			log.Printf("could not generate token for %s: %v", email, err)
-			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+			m.LoginAttempts.WithLabelValues("request", "error").Inc()
+			logger.Error("failed to generate login token", "email", email, "error", err)
+			checkYourEmail()
 			return
 		}
-		if err := auth.SendMagicLink(email, token); err != nil {
-			log.Printf("could not send email to %s: %v", email, err)
-			http.Redirect(w, r, "/check-your-email", http.StatusFound)
+		code, err := magiclinks.NewCode()
+		if err != nil {
+			m.LoginAttempts.WithLabelValues("request", "error").Inc()
+			logger.Error("failed to generate login code", "email", email, "error", err)
+			checkYourEmail()
 			return
 		}
-		log.Printf("magic login link sent to %s", email)
+		link := magiclinks.Link{
+			ID:        claims.ID,
+			Email:     email,
+			Code:      code,
+			Remember:  remember,
+			ExpiresAt: claims.ExpiresAt,
+		}
+		if err := magicLinks.Issue(r.Context(), link, invalidateOlderLinks); err != nil {
+			m.LoginAttempts.WithLabelValues("request", "error").Inc()
+			logger.Error("failed to record magic link", "email", email, "error", err)
+			checkYourEmail()
+			return
+		}
+		if err := auth.SendMagicLink(r.Context(), email, token, code); err != nil {
+			m.LoginAttempts.WithLabelValues("request", "error").Inc()
+			logger.Error("failed to send magic link", "email", email, "error", err)
+			checkYourEmail()
+			return
+		}
+		m.LoginAttempts.WithLabelValues("request", "sent").Inc()
+		logger.Info("magic link sent", "email", email)
+
+		cookie := auth.BindLoginCode(claims)
+		http.SetCookie(w, &cookie)
 
 		http.Redirect(w, r, "/check-your-email", http.StatusFound)
 	}
 }
 
+// LoginGetHandler shows the page a magic link leads to, which asks to
+// confirm the login. Mail scanners and link previews fetch the link
+// without submitting the form, so they don't use it up.
 func LoginGetHandler(auth authentication.Auth) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		token := r.URL.Query().Get("token")
+		if _, err := auth.ValidateMagicLink(token); err != nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		rid := r.URL.Query().Get("rid")
+		if !requestid.Valid(rid) {
+			rid = ""
+		}
+
+		err := views.LayoutBare(views.ConfirmLogin(token, rid)).Render(r.Context(), w)
+		if err != nil {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+			return
+		}
+	}
+}
+
+// LoginLinkHandler exchanges a magic link for a session, or a partial one
+// if the user needs a second factor. Each link works only once.
+func LoginLinkHandler(magicLinks magiclinks.MagicLinkStore, auth authentication.Auth, twoFactor *twofactor.Service, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		token := r.PostFormValue("token")
 		if token == "" {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
-		email, err := auth.ValidateToken(token)
+		// rid is the ID of the request that sent the link.
+		logger := logging.FromContext(r.Context())
+		if rid := r.PostFormValue("rid"); requestid.Valid(rid) {
+			logger = logger.With("login_request_id", rid)
+		}
+
+		claims, err := auth.ValidateMagicLink(token)
 		if err != nil {
+			m.LoginAttempts.WithLabelValues("verify", "invalid").Inc()
+			logger.Info("rejected login link", "error", err)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		if err := magicLinks.Consume(r.Context(), claims.ID); err != nil {
+			switch {
+			case errors.Is(err, magiclinks.ErrAlreadyUsed):
+				m.LoginAttempts.WithLabelValues("verify", "reused").Inc()
+				logger.Warn("magic link reused", "security_event", "magic_link_reuse", "email", claims.Email, "link_id", claims.ID)
+			case errors.Is(err, magiclinks.ErrInvalidLink):
+				m.LoginAttempts.WithLabelValues("verify", "invalid").Inc()
+				logger.Info("rejected superseded or unknown login link", "email", claims.Email, "link_id", claims.ID)
+			default:
+				m.LoginAttempts.WithLabelValues("verify", "error").Inc()
+				logger.Error("failed to consume magic link", "error", err)
+			}
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
+		m.LoginAttempts.WithLabelValues("verify", "success").Inc()
 
-		cookie := auth.LoggedIn(token)
-		http.SetCookie(w, &cookie)
+		next, err := startSession(w, r, auth, twoFactor, claims)
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
 
-		log.Printf("User %s logged in via magic link", email)
-		http.Redirect(w, r, "/record-event", http.StatusFound)
+		logger.Info("logged in via magic link", "user", claims.Email, "remember", claims.Remember)
+		http.Redirect(w, r, next, http.StatusFound)
 	}
 }
 
+// LogoutHandler revokes the session, so its token stops working even if
+// it was copied elsewhere.
 func LogoutHandler(auth authentication.Auth) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		cookie := auth.LoggedOut()
+		cookie, err := auth.LoggedOut(r)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to revoke session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
 		http.SetCookie(w, &cookie)
 
-		log.Println("User logged out")
+		logging.FromContext(r.Context()).Info("logged out")
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
 }
 
+// LoginCodeHandler logs in with the code from the magic link email, if it
+// is entered in the browser that asked for the link.
+func LoginCodeHandler(magicLinks magiclinks.MagicLinkStore, auth authentication.Auth, twoFactor *twofactor.Service, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		retry := func(problem string) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			if err := views.LayoutBare(views.CheckYourEmail(problem)).Render(r.Context(), w); err != nil {
+				logger.Error("failed to render page", "error", err)
+			}
+		}
+
+		linkID, err := auth.BoundLoginCode(r)
+		if err != nil {
+			m.LoginAttempts.WithLabelValues("code", "unbound").Inc()
+			logger.Info("login code entered in a browser that didn't ask for it")
+			retry("This code can only be used in the browser you asked for it in. Please open the link from the email instead.")
+			return
+		}
+
+		link, err := magicLinks.ConsumeCode(r.Context(), linkID, strings.TrimSpace(r.FormValue("code")))
+		if err != nil {
+			switch {
+			case errors.Is(err, magiclinks.ErrWrongCode):
+				m.LoginAttempts.WithLabelValues("code", "wrong").Inc()
+				logger.Info("wrong login code", "link_id", linkID)
+				retry("That code is not correct.")
+			case errors.Is(err, magiclinks.ErrTooManyAttempts):
+				m.LoginAttempts.WithLabelValues("code", "locked").Inc()
+				logger.Warn("login code locked after too many attempts", "security_event", "login_code_locked", "link_id", linkID)
+				retry("Too many wrong codes. Please open the link from the email or ask for a new one.")
+			case errors.Is(err, magiclinks.ErrAlreadyUsed):
+				m.LoginAttempts.WithLabelValues("code", "reused").Inc()
+				logger.Warn("login code reused", "security_event", "magic_link_reuse", "link_id", linkID)
+				retry("This code has been used already. Please ask for a new one.")
+			case errors.Is(err, magiclinks.ErrInvalidLink):
+				m.LoginAttempts.WithLabelValues("code", "invalid").Inc()
+				logger.Info("rejected expired or superseded login code", "link_id", linkID)
+				retry("This code has expired. Please ask for a new one.")
+			default:
+				m.LoginAttempts.WithLabelValues("code", "error").Inc()
+				logger.Error("failed to check login code", "error", err)
+				httpError(w, r, "internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		m.LoginAttempts.WithLabelValues("code", "success").Inc()
+
+		claims := authentication.Claims{ID: link.ID, Email: link.Email, Remember: link.Remember}
+		next, err := startSession(w, r, auth, twoFactor, claims)
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("logged in via login code", "user", claims.Email, "remember", claims.Remember)
+		http.Redirect(w, r, next, http.StatusFound)
+	}
+}
+
 func CheckYourEmailHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	err := views.LayoutBare(views.CheckYourEmail()).Render(r.Context(), w)
+	err := views.LayoutBare(views.CheckYourEmail("")).Render(r.Context(), w)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error rendering layout: %v", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 		return
 	}
 }
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+	"github.com/erkannt/rechenschaftspflicht/services/keyring"
+	"github.com/erkannt/rechenschaftspflicht/services/magiclinks"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/julienschmidt/httprouter"
+)
+
+// mailbox is an Auth that keeps the magic links it is asked to send.
+type mailbox struct {
+	authentication.Auth
+	tokens map[string]string
+	codes  map[string]string
+}
+
+func (m *mailbox) SendMagicLink(_ context.Context, toEmail, token, code string) error {
+	m.tokens[toEmail] = token
+	m.codes[toEmail] = code
+	return nil
+}
+
+type testEnv struct {
+	db         *sql.DB
+	users      userstore.UserStore
+	magicLinks magiclinks.MagicLinkStore
+	twoFactor  *twofactor.Service
+	auth       *mailbox
+	m          *metrics.Metrics
+}
+
+// newTestEnv sets up the services on a fresh database. Users with one of
+// requiredRoles must use a second factor.
+func newTestEnv(t *testing.T, requiredRoles ...string) *testEnv {
+	t.Helper()
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	keys, err := keyring.New([]string{"test:test-secret"}, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	auth := authentication.New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+		AppOrigin:         "http://localhost:8080",
+		MagicLinkTTL:      15 * time.Minute,
+		SessionTTL:        time.Hour,
+		RememberDeviceTTL: 24 * time.Hour,
+	}, keys, sessions.NewSessionStore(db))
+
+	users := userstore.NewUserStore(db)
+	return &testEnv{
+		db:         db,
+		users:      users,
+		magicLinks: magiclinks.NewMagicLinkStore(db),
+		twoFactor:  twofactor.New("Test", twofactor.NewTwoFactorStore(db), users, requiredRoles),
+		auth:       &mailbox{Auth: auth, tokens: map[string]string{}, codes: map[string]string{}},
+		m:          metrics.New(),
+	}
+}
+
+func (e *testEnv) addUser(t *testing.T, email string, roles ...string) {
+	t.Helper()
+	if err := e.users.AddUser(context.Background(), email, strings.Split(email, "@")[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := e.users.SetRoles(context.Background(), email, roles); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func postForm(h httprouter.Handle, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h(w, r, nil)
+	return w
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// requestLogin asks for a magic link for email and returns the login code
+// cookie the browser was given.
+func (e *testEnv) requestLogin(t *testing.T, email string) *http.Cookie {
+	t.Helper()
+	h := LoginPostHandler(e.users, e.magicLinks, e.auth, e.m, true, 0)
+	w := postForm(h, "/login", url.Values{"email": {email}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/check-your-email" {
+		t.Fatalf("expected redirect to /check-your-email, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookie := responseCookie(w, "login_code")
+	if cookie == nil {
+		t.Fatalf("expected a login code cookie for %s", email)
+	}
+	return cookie
+}
+
+func TestLoginPostDoesNotRevealUnknownUsers(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "known@example.com")
+
+	known := e.requestLogin(t, "known@example.com")
+	unknown := e.requestLogin(t, "unknown@example.com")
+
+	if _, sent := e.auth.codes["unknown@example.com"]; sent {
+		t.Error("expected no email to an unknown address")
+	}
+	if len(known.Value) != len(unknown.Value) || known.Path != unknown.Path ||
+		known.HttpOnly != unknown.HttpOnly || known.Expires.Sub(unknown.Expires).Abs() > time.Second {
+		t.Errorf("expected cookies to look alike, got %+v and %+v", known, unknown)
+	}
+}
+
+func TestLoginCode(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "user@example.com")
+	h := LoginCodeHandler(e.magicLinks, e.auth, e.twoFactor, e.m)
+
+	bound := e.requestLogin(t, "user@example.com")
+	code := e.auth.codes["user@example.com"]
+
+	if w := postForm(h, "/login/code", url.Values{"code": {code}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d without a bound browser, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	decoy := e.requestLogin(t, "unknown@example.com")
+	if w := postForm(h, "/login/code", url.Values{"code": {code}}, decoy); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d in a browser bound to another request, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if w := postForm(h, "/login/code", url.Values{"code": {"not-it"}}, bound); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d for a wrong code, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+
+	w := postForm(h, "/login/code", url.Values{"code": {" " + code + " "}}, bound)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/record-event" {
+		t.Fatalf("expected redirect to /record-event, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if responseCookie(w, "auth") == nil {
+		t.Error("expected a session cookie")
+	}
+
+	if w := postForm(h, "/login/code", url.Values{"code": {code}}, bound); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d for a reused code, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+func TestMagicLinkIsUsedOnlyWhenConfirmed(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "user@example.com")
+	e.requestLogin(t, "user@example.com")
+	token := e.auth.tokens["user@example.com"]
+
+	get := LoginGetHandler(e.auth)
+	for range 2 {
+		w := httptest.NewRecorder()
+		get(w, httptest.NewRequest(http.MethodGet, "/login?token="+url.QueryEscape(token), nil), nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/login/link"`) {
+			t.Fatalf("expected a confirmation form, got %d", w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	get(w, httptest.NewRequest(http.MethodGet, "/login?token=not-a-token", nil), nil)
+	if w.Code != http.StatusFound {
+		t.Errorf("expected invalid links to redirect, got %d", w.Code)
+	}
+
+	post := LoginLinkHandler(e.magicLinks, e.auth, e.twoFactor, e.m)
+	w = postForm(post, "/login/link", url.Values{"token": {token}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/record-event" {
+		t.Fatalf("expected redirect to /record-event, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if responseCookie(w, "auth") == nil {
+		t.Error("expected a session cookie")
+	}
+
+	w = postForm(post, "/login/link", url.Values{"token": {token}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" || responseCookie(w, "auth") != nil {
+		t.Errorf("expected a reused link to be rejected, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestLoginCodeLocksAfterTooManyAttempts(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "user@example.com")
+	h := LoginCodeHandler(e.magicLinks, e.auth, e.twoFactor, e.m)
+
+	bound := e.requestLogin(t, "user@example.com")
+	for range magiclinks.MaxCodeAttempts {
+		postForm(h, "/login/code", url.Values{"code": {"not-it"}}, bound)
+	}
+
+	w := postForm(h, "/login/code", url.Values{"code": {e.auth.codes["user@example.com"]}}, bound)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Too many wrong codes") {
+		t.Errorf("expected the code to be locked, got %d", w.Code)
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/requestid"
+	"github.com/erkannt/rechenschaftspflicht/views"
+)
+
+// httpError replies like http.Error, but includes the request ID so users
+// can quote it. Browsers get an HTML page, everyone else plain text.
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	id := requestid.FromContext(r.Context())
+	if negotiate(r.Header.Get("Accept"), "text/plain", "text/html") != "text/html" {
+		if id != "" {
+			message = fmt.Sprintf("%s\nrequest id: %s", message, id)
+		}
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := views.LayoutBare(views.ErrorPage(http.StatusText(code), message, id)).Render(r.Context(), w); err != nil {
+		logging.FromContext(r.Context()).Error("failed to render error page", "error", err)
+	}
+}
+
+// CSRFFailureHandler answers form posts that failed the CSRF check.
+func CSRFFailureHandler(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, "This form could not be accepted: it was sent from another site or has expired. Please go back, reload the page and try again.", http.StatusForbidden)
+}
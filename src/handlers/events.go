@@ -3,13 +3,15 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/erkannt/rechenschaftspflicht/services/authentication"
 	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/export"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
 	"github.com/erkannt/rechenschaftspflicht/views"
 	"github.com/julienschmidt/httprouter"
 )
@@ -23,11 +25,54 @@ type EventResponse struct {
 	RecordedBy string  `json:"recordedBy"`
 }
 
+// eventFilter reads the list view's filter parameters from the query string.
+func eventFilter(r *http.Request) eventstore.Filter {
+	q := r.URL.Query()
+	return eventstore.Filter{
+		Tag:        q.Get("tag"),
+		RecordedBy: q.Get("user"),
+		From:       q.Get("from"),
+		To:         q.Get("to"),
+	}
+}
+
+// filterQuery encodes a filter and page back into a query string, including
+// the leading "?" when non-empty, so links can carry the current filters.
+// A page of 0 is omitted.
+func filterQuery(filter eventstore.Filter, page int) string {
+	q := url.Values{}
+	for key, value := range map[string]string{
+		"tag":  filter.Tag,
+		"user": filter.RecordedBy,
+		"from": filter.From,
+		"to":   filter.To,
+	} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	if page > 0 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
 func RecordEventFormHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	err := views.LayoutWithNav(views.NewEventForm()).Render(r.Context(), w)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error rendering layout: %v", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 		return
 	}
 }
@@ -35,7 +80,7 @@ func RecordEventFormHandler(w http.ResponseWriter, r *http.Request, _ httprouter
 func RecordEventPostHandler(eventStore eventstore.EventStore, auth authentication.Auth) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		if err := r.ParseForm(); err != nil {
-			http.Error(w, "invalid form data", http.StatusBadRequest)
+			httpError(w, r, "invalid form data", http.StatusBadRequest)
 			return
 		}
 
@@ -54,47 +99,108 @@ func RecordEventPostHandler(eventStore eventstore.EventStore, auth authenticatio
 			RecordedBy: recordedBy,
 		}
 
-		if err := eventStore.Record(event); err != nil {
-			fmt.Printf("failed to record event: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		if err := eventStore.Record(r.Context(), event); err != nil {
+			logging.FromContext(r.Context()).Error("failed to record event", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		fmt.Printf("Received: %+v\n", event)
+		logging.FromContext(r.Context()).Info("recorded event", "tag", event.Tag)
 
 		err := views.LayoutWithNav(views.NewEventFormWithSuccessBanner()).Render(r.Context(), w)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error rendering layout: %v", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 			return
 		}
 	}
 }
 
-func AllEventsHandler(eventStore eventstore.EventStore) httprouter.Handle {
+const eventsPerPage = 50
+
+// listingMediaTypes are the representations AllEventsHandler can serve, in
+// order of preference.
+var listingMediaTypes = []string{
+	"text/html",
+	"application/json",
+	"text/csv",
+	"application/x-ndjson",
+	"application/atom+xml",
+}
+
+func AllEventsHandler(eventStore eventstore.EventStore, appOrigin string) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		events, err := eventStore.GetAll()
+		w.Header().Add("Vary", "Accept")
+		mediaType := negotiate(r.Header.Get("Accept"), listingMediaTypes...)
+		if mediaType == "" {
+			httpError(w, r, "not acceptable", http.StatusNotAcceptable)
+			return
+		}
+
+		filter := eventFilter(r)
+		page := pageNumber(r)
+		filter.Limit = eventsPerPage + 1
+		filter.Offset = (page - 1) * eventsPerPage
+
+		events, err := eventStore.Find(r.Context(), filter)
 		if err != nil {
-			fmt.Printf("failed to retrieve events: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to retrieve events", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		pagination := views.Pagination{}
+		if len(events) > eventsPerPage {
+			events = events[:eventsPerPage]
+			pagination.Next = "/all-events" + filterQuery(filter, page+1)
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="next"`, appOrigin, pagination.Next))
+		}
+		if page > 1 {
+			pagination.Prev = "/all-events" + filterQuery(filter, page-1)
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="prev"`, appOrigin, pagination.Prev))
+		}
+
+		if mediaType != "text/html" {
+			format := listingFormat(mediaType, export.AtomFeed{
+				Title:     "Rechenschaftspflicht events",
+				SelfURL:   appOrigin + "/all-events" + filterQuery(filter, page),
+				AppOrigin: appOrigin,
+			})
+			w.Header().Set("Content-Type", format.ContentType)
+			if err := writeEventSlice(w, events, format); err != nil {
+				logging.FromContext(r.Context()).Error("failed to write events", "format", format.Extension, "error", err)
+			}
 			return
 		}
 
-		err = views.LayoutWithNav(views.AllEvents(events)).Render(r.Context(), w)
+		err = views.LayoutWithNav(views.AllEvents(events, filter, filterQuery(filter, 0), pagination)).Render(r.Context(), w)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error rendering layout: %v", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 			return
 		}
 	}
 }
 
+func listingFormat(mediaType string, feed export.AtomFeed) export.Format {
+	switch mediaType {
+	case "application/json":
+		return export.JSON
+	case "text/csv":
+		return export.CSV
+	case "application/x-ndjson":
+		return export.NDJSON
+	default:
+		return export.Atom(feed)
+	}
+}
+
 func EventsJsonHandler(eventStore eventstore.EventStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		events, err := eventStore.GetAll()
+		events, err := eventStore.GetAll(r.Context())
 		if err != nil {
-			fmt.Printf("failed to retrieve events: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to retrieve events", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
 			return
 		}
 
@@ -122,8 +228,8 @@ func EventsJsonHandler(eventStore eventstore.EventStore) httprouter.Handle {
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(eventResponses); err != nil {
-			fmt.Printf("failed to encode events to json: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to encode events to json", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
 			return
 		}
 	}
@@ -131,17 +237,17 @@ func EventsJsonHandler(eventStore eventstore.EventStore) httprouter.Handle {
 
 func PlotsHandler(eventStore eventstore.EventStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		events, err := eventStore.GetAll()
+		events, err := eventStore.GetAll(r.Context())
 		if err != nil {
-			fmt.Printf("failed to retrieve events: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to retrieve events", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
 			return
 		}
 
 		err = views.LayoutWithNav(views.Plots(events)).Render(r.Context(), w)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error rendering layout: %v", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
 			return
 		}
 	}
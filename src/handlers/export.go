@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/export"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+func ExportEventsHandler(eventStore eventstore.EventStore, format export.Format) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		filename := fmt.Sprintf("events-%s.%s", time.Now().Format("2006-01-02"), format.Extension)
+		w.Header().Set("Content-Type", format.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		if err := writeEvents(r.Context(), w, eventStore, eventFilter(r), format); err != nil {
+			// Headers and possibly part of the body are already sent, so
+			// all we can do is log and cut the response short.
+			logging.FromContext(r.Context()).Error("failed to export events", "format", format.Extension, "error", err)
+		}
+	}
+}
+
+func writeEvents(ctx context.Context, w io.Writer, eventStore eventstore.EventStore, filter eventstore.Filter, format export.Format) error {
+	ew, err := format.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := eventStore.Each(ctx, filter, ew.Write); err != nil {
+		_ = ew.Close()
+		return err
+	}
+	return ew.Close()
+}
+
+func writeEventSlice(w io.Writer, events []eventstore.Event, format export.Format) error {
+	ew, err := format.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := ew.Write(e); err != nil {
+			_ = ew.Close()
+			return err
+		}
+	}
+	return ew.Close()
+}
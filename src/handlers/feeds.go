@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/export"
+	"github.com/erkannt/rechenschaftspflicht/services/feedtokens"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/erkannt/rechenschaftspflicht/views"
+	"github.com/julienschmidt/httprouter"
+)
+
+// feedEntries caps the number of events in a feed; readers poll
+// regularly and only care about recent activity.
+const feedEntries = 100
+
+func FeedsHandler(feedTokens feedtokens.FeedTokenStore, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, _ := auth.GetLoggedInUserEmail(r)
+		token, active, err := feedTokens.Active(email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to look up feed token", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		page := views.FeedsPage{Active: active, CreatedAt: token.CreatedAt}
+		err = views.LayoutWithNav(views.Feeds(page)).Render(r.Context(), w)
+		if err != nil {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+			return
+		}
+	}
+}
+
+func CreateFeedTokenHandler(feedTokens feedtokens.FeedTokenStore, auth authentication.Auth, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, _ := auth.GetLoggedInUserEmail(r)
+		token, err := feedTokens.Create(email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to create feed token", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("created feed token")
+
+		base := appOrigin + "/feed/" + token
+		page := views.FeedsPage{
+			Active: true,
+			URLs: &views.FeedURLs{
+				All:      base + "/all",
+				ByUser:   base + "/users/USERNAME",
+				ByTag:    base + "/tags/TAG",
+				Calendar: base + "/events.ics",
+			},
+		}
+		err = views.LayoutWithNav(views.Feeds(page)).Render(r.Context(), w)
+		if err != nil {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+			return
+		}
+	}
+}
+
+func RevokeFeedTokenHandler(feedTokens feedtokens.FeedTokenStore, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, _ := auth.GetLoggedInUserEmail(r)
+		if err := feedTokens.Revoke(email); err != nil {
+			logging.FromContext(r.Context()).Error("failed to revoke feed token", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("revoked feed token")
+
+		http.Redirect(w, r, "/feeds", http.StatusFound)
+	}
+}
+
+// lookupFeedToken responds with 404 and returns false unless the :token
+// route parameter is an active feed token of someone who is still a user.
+func lookupFeedToken(w http.ResponseWriter, r *http.Request, feedTokens feedtokens.FeedTokenStore, userStore userstore.UserStore, ps httprouter.Params) bool {
+	logger := logging.FromContext(r.Context())
+	owner, err := feedTokens.Lookup(ps.ByName("token"))
+	if err != nil {
+		if !errors.Is(err, feedtokens.ErrInvalidToken) {
+			logger.Error("failed to look up feed token", "error", err)
+		}
+		httpError(w, r, "not found", http.StatusNotFound)
+		return false
+	}
+
+	exists, err := userStore.IsUser(r.Context(), owner)
+	if err != nil {
+		logger.Error("failed to check if feed token owner exists", "error", err)
+		httpError(w, r, "internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		logger.Info("rejected feed token of a removed user", "user", owner)
+		httpError(w, r, "not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// AtomFeedHandler serves the events matching the optional :user or :tag
+// route parameter as an Atom feed, authenticated by the :token parameter.
+func AtomFeedHandler(eventStore eventstore.EventStore, feedTokens feedtokens.FeedTokenStore, userStore userstore.UserStore, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !lookupFeedToken(w, r, feedTokens, userStore, ps) {
+			return
+		}
+
+		filter := eventstore.Filter{
+			Tag:        ps.ByName("tag"),
+			RecordedBy: ps.ByName("user"),
+			Limit:      feedEntries,
+		}
+		title, feedPath := "Rechenschaftspflicht: all events", "all"
+		switch {
+		case filter.Tag != "":
+			title = fmt.Sprintf("Rechenschaftspflicht: events tagged %s", filter.Tag)
+			feedPath = "tags/" + url.PathEscape(filter.Tag)
+		case filter.RecordedBy != "":
+			title = fmt.Sprintf("Rechenschaftspflicht: events by %s", filter.RecordedBy)
+			feedPath = "users/" + url.PathEscape(filter.RecordedBy)
+		}
+
+		// The feed ID leaves out the token so that it stays stable when
+		// the token is rotated.
+		format := export.Atom(export.AtomFeed{
+			ID:        appOrigin + "/feed/" + feedPath,
+			Title:     title,
+			SelfURL:   appOrigin + r.URL.RequestURI(),
+			AppOrigin: appOrigin,
+		})
+
+		w.Header().Set("Content-Type", format.ContentType)
+		if err := writeEvents(r.Context(), w, eventStore, filter, format); err != nil {
+			logging.FromContext(r.Context()).Error("failed to write atom feed", "error", err)
+		}
+	}
+}
+
+// ICalFeedHandler serves events as an iCalendar feed, narrowed down by the
+// same query parameters as the list view and authenticated by :token.
+func ICalFeedHandler(eventStore eventstore.EventStore, feedTokens feedtokens.FeedTokenStore, userStore userstore.UserStore, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !lookupFeedToken(w, r, feedTokens, userStore, ps) {
+			return
+		}
+
+		filter := eventFilter(r)
+		name := "Rechenschaftspflicht"
+		if filter.Tag != "" {
+			name += " " + filter.Tag
+		}
+		if filter.RecordedBy != "" {
+			name += " by " + filter.RecordedBy
+		}
+
+		format := export.ICal(export.Calendar{Name: name, AppOrigin: appOrigin})
+		w.Header().Set("Content-Type", format.ContentType)
+		if err := writeEvents(r.Context(), w, eventStore, filter, format); err != nil {
+			logging.FromContext(r.Context()).Error("failed to write calendar feed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/feedtokens"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestFeedRequiresActiveTokenOfAUser(t *testing.T) {
+	e := newTestEnv(t)
+	e.addUser(t, "user@example.com")
+	feedTokens := feedtokens.NewFeedTokenStore(e.db)
+
+	valid, err := feedTokens.Create("user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	revoked, err := feedTokens.Create("other@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := feedTokens.Revoke("other@example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Tokens outlive the removal of their owner in the store.
+	orphaned, err := feedTokens.Create("removed@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	router := httprouter.New()
+	eventStore := eventstore.NewEventStore(e.db)
+	router.GET("/feed/:token/all", AtomFeedHandler(eventStore, feedTokens, e.users, "http://localhost:8080"))
+	router.GET("/feed/:token/events.ics", ICalFeedHandler(eventStore, feedTokens, e.users, "http://localhost:8080"))
+
+	cases := map[string]int{
+		valid:           http.StatusOK,
+		"unknown-token": http.StatusNotFound,
+		revoked:         http.StatusNotFound,
+		orphaned:        http.StatusNotFound,
+	}
+	for token, want := range cases {
+		for _, feed := range []string{"all", "events.ics"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/feed/"+token+"/"+feed, nil))
+			if w.Code != want {
+				t.Errorf("%s with token %q: expected %d, got %d", feed, token, want, w.Code)
+			}
+		}
+	}
+}
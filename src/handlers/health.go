@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+// HealthzHandler reports that the process is up and serving requests.
+func HealthzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+type readiness struct {
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	Mailer   string `json:"mailer"`
+}
+
+// mailerCheckInterval is how long a mailer check result is reused, so
+// probes don't open an SMTP session each time.
+const mailerCheckInterval = 30 * time.Second
+
+// mailerCheck caches the result of pinging the mailer.
+type mailerCheck struct {
+	mu        sync.Mutex
+	auth      authentication.Auth
+	err       error
+	checkedAt time.Time
+}
+
+func (c *mailerCheck) ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < mailerCheckInterval {
+		return c.err
+	}
+	c.err = c.auth.PingMailer(ctx)
+	c.checkedAt = time.Now()
+	if c.err != nil {
+		logging.FromContext(ctx).Warn("mailer is not ready", "error", c.err)
+	}
+	return c.err
+}
+
+// ReadyzHandler reports whether the server can handle requests. An
+// unreachable database makes it unready; the mailer status is reported but
+// doesn't fail the check, as only logins depend on it. The response only
+// says which checks fail, the reasons are logged.
+func ReadyzHandler(db *sql.DB, auth authentication.Auth) httprouter.Handle {
+	mailer := &mailerCheck{auth: auth}
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		result := readiness{Status: "ok", Database: "ok", Mailer: "ok"}
+		status := http.StatusOK
+
+		var one int
+		if err := db.QueryRowContext(ctx, "SELECT 1;").Scan(&one); err != nil {
+			logger.Error("database is not ready", "error", err)
+			result.Status = "unavailable"
+			result.Database = "failing"
+			status = http.StatusServiceUnavailable
+		}
+		if err := mailer.ping(ctx); err != nil {
+			result.Mailer = "failing"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
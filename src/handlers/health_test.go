@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+)
+
+type pingCounter struct {
+	authentication.Auth
+	err   error
+	pings int
+}
+
+func (p *pingCounter) PingMailer(context.Context) error {
+	p.pings++
+	return p.err
+}
+
+func readyz(t *testing.T, h func(http.ResponseWriter, *http.Request)) (int, readiness) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var result readiness
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return w.Code, result
+}
+
+func TestReadyz(t *testing.T) {
+	e := newTestEnv(t)
+	mailer := &pingCounter{err: errors.New("connection refused")}
+	h := ReadyzHandler(e.db, mailer)
+	serve := func(w http.ResponseWriter, r *http.Request) { h(w, r, nil) }
+
+	code, result := readyz(t, serve)
+	want := readiness{Status: "ok", Database: "ok", Mailer: "failing"}
+	if code != http.StatusOK || result != want {
+		t.Errorf("expected %d %+v, got %d %+v", http.StatusOK, want, code, result)
+	}
+
+	if err := e.db.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	code, result = readyz(t, serve)
+	want = readiness{Status: "unavailable", Database: "failing", Mailer: "failing"}
+	if code != http.StatusServiceUnavailable || result != want {
+		t.Errorf("expected %d %+v, got %d %+v", http.StatusServiceUnavailable, want, code, result)
+	}
+
+	if mailer.pings != 1 {
+		t.Errorf("expected the mailer result to be reused, got %d pings", mailer.pings)
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// EventMetricsHandler exposes per user and tag aggregates of the recorded
+// events in the Prometheus and OpenMetrics text formats.
+func EventMetricsHandler(eventStore eventstore.EventStore) httprouter.Handle {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewEventsCollector(eventStore))
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// OperationalMetricsHandler exposes the server's own metrics, such as
+// request latencies and email delivery counts.
+func OperationalMetricsHandler(m *metrics.Metrics) httprouter.Handle {
+	handler := promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handler.ServeHTTP(w, r)
+	}
+}
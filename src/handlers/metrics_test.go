@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/middlewares"
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
+)
+
+func TestMetricsRequireMetricsScope(t *testing.T) {
+	e := newTestEnv(t)
+	apiTokens := apitokens.NewAPITokenStore(e.db)
+	scraper, err := apiTokens.Create("grafana", []string{apitokens.ScopeMetricsRead})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	unscoped, err := apiTokens.Create("script", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := middlewares.RequireScope(apiTokens, apitokens.ScopeMetricsRead)(OperationalMetricsHandler(e.m))
+
+	cases := map[string]int{
+		"":                   http.StatusUnauthorized,
+		"Bearer not-a-token": http.StatusUnauthorized,
+		"Bearer " + unscoped: http.StatusForbidden,
+		"Bearer " + scraper:  http.StatusOK,
+	}
+	for authorization, want := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != want {
+			t.Errorf("%q: expected %d, got %d", authorization, want, w.Code)
+		}
+		if w.Code != http.StatusOK && strings.Contains(w.Body.String(), "# TYPE") {
+			t.Errorf("%q: rejected request got metrics", authorization)
+		}
+	}
+}
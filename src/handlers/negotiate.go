@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the offered media type that best matches the Accept
+// header, or "" if none is acceptable. An empty Accept header accepts the
+// first offer; ties are broken by the order of the offers.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific matching media range determines the quality.
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, rangeQ := parseMediaRange(part)
+			if s := matchMediaRange(mediaRange, offer); s > specificity {
+				q, specificity = rangeQ, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func parseMediaRange(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+	q := 1.0
+	for _, param := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(key, "q") {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return mediaRange, q
+}
+
+// matchMediaRange reports how specifically mediaRange matches offer: 2 for
+// an exact match, 1 for type/*, 0 for */* and -1 for no match.
+func matchMediaRange(mediaRange, offer string) int {
+	switch {
+	case mediaRange == offer:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/csv"}
+
+	cases := map[string]string{
+		"":                                 "text/html",
+		"*/*":                              "text/html",
+		"application/json":                 "application/json",
+		"text/csv;q=0.5, application/json": "application/json",
+		"text/*;q=0.3, text/csv":           "text/csv",
+		"text/html;q=0, */*;q=0.1":         "application/json",
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": "text/html",
+		"image/png": "",
+	}
+
+	for accept, want := range cases {
+		if got := negotiate(accept, offers...); got != want {
+			t.Errorf("Accept %q: expected '%s', got '%s'", accept, want, got)
+		}
+	}
+}
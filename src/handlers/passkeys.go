@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/passkeys"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/erkannt/rechenschaftspflicht/views"
+	"github.com/julienschmidt/httprouter"
+)
+
+// passkeyCeremonyCookie binds a registration or login ceremony to the
+// browser that started it.
+const passkeyCeremonyCookie = "passkey_ceremony"
+
+func setPasskeyCeremony(w http.ResponseWriter, appOrigin, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCeremonyCookie,
+		Value:    id,
+		Path:     "/passkeys",
+		Expires:  time.Now().Add(5 * time.Minute),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(appOrigin, "https"),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// takePasskeyCeremony returns the ID of the browser's ceremony and clears
+// the cookie holding it.
+func takePasskeyCeremony(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(passkeyCeremonyCookie)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: passkeyCeremonyCookie, Path: "/passkeys", MaxAge: -1})
+	return cookie.Value
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode response", "error", err)
+	}
+}
+
+// PasskeysHandler lists the user's passkeys and lets them add more.
+func PasskeysHandler(service *passkeys.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		list, err := service.List(r.Context(), email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to list passkeys", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = views.LayoutWithNav(views.Passkeys(list)).Render(r.Context(), w)
+		if err != nil {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+			return
+		}
+	}
+}
+
+// BeginPasskeyRegistrationHandler returns the options for creating a
+// passkey for the logged in user.
+func BeginPasskeyRegistrationHandler(service *passkeys.Service, auth authentication.Auth, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		creation, ceremonyID, err := service.BeginRegistration(r.Context(), email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to begin passkey registration", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		setPasskeyCeremony(w, appOrigin, ceremonyID)
+		writeJSON(w, r, creation)
+	}
+}
+
+// FinishPasskeyRegistrationHandler stores the passkey the browser created,
+// named after the name query parameter.
+func FinishPasskeyRegistrationHandler(service *passkeys.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" {
+			name = "Passkey"
+		}
+
+		err = service.FinishRegistration(r.Context(), email, name, takePasskeyCeremony(w, r), r.Body)
+		if errors.Is(err, passkeys.ErrNotFound) {
+			logger.Info("passkey registration expired or was not started")
+			httpError(w, r, "This request has expired, please try again.", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Info("rejected passkey registration", "error", err)
+			httpError(w, r, "The passkey could not be registered.", http.StatusBadRequest)
+			return
+		}
+		logger.Info("registered passkey", "name", name)
+		writeJSON(w, r, map[string]string{"redirect": "/passkeys"})
+	}
+}
+
+// RemovePasskeyHandler deletes one of the user's passkeys, identified by
+// its base64url-encoded credential ID.
+func RemovePasskeyHandler(service *passkeys.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		id, err := base64.RawURLEncoding.DecodeString(r.FormValue("id"))
+		if err != nil {
+			httpError(w, r, "invalid passkey", http.StatusBadRequest)
+			return
+		}
+		if err := service.Remove(r.Context(), email, id); err != nil {
+			logging.FromContext(r.Context()).Error("failed to remove passkey", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("removed passkey")
+		http.Redirect(w, r, "/passkeys", http.StatusFound)
+	}
+}
+
+// BeginPasskeyLoginHandler returns a challenge any registered passkey can
+// answer.
+func BeginPasskeyLoginHandler(service *passkeys.Service, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		assertion, ceremonyID, err := service.BeginLogin(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to begin passkey login", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		setPasskeyCeremony(w, appOrigin, ceremonyID)
+		writeJSON(w, r, assertion)
+	}
+}
+
+// FinishPasskeyLoginHandler starts a session for the owner of the passkey
+// that answered the challenge, remembering the device if the remember
+// query parameter is on.
+func FinishPasskeyLoginHandler(service *passkeys.Service, userStore userstore.UserStore, auth authentication.Auth, twoFactor *twofactor.Service, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		email, err := service.FinishLogin(r.Context(), takePasskeyCeremony(w, r), r.Body)
+		if err != nil {
+			switch {
+			case errors.Is(err, passkeys.ErrCloned):
+				m.LoginAttempts.WithLabelValues("passkey", "cloned").Inc()
+				logger.Warn("passkey may have been cloned", "security_event", "passkey_clone_warning", "email", email, "error", err)
+				httpError(w, r, "This passkey can't be used. Please log in with a magic link instead.", http.StatusUnauthorized)
+			case errors.Is(err, passkeys.ErrNotFound):
+				m.LoginAttempts.WithLabelValues("passkey", "expired").Inc()
+				logger.Info("passkey login expired or was not started")
+				httpError(w, r, "This request has expired, please try again.", http.StatusBadRequest)
+			default:
+				m.LoginAttempts.WithLabelValues("passkey", "invalid").Inc()
+				logger.Info("rejected passkey login", "error", err)
+				httpError(w, r, "The passkey was not accepted.", http.StatusUnauthorized)
+			}
+			return
+		}
+
+		// Passkeys outlive removal from the users table.
+		exists, err := userStore.IsUser(r.Context(), email)
+		if err != nil {
+			m.LoginAttempts.WithLabelValues("passkey", "error").Inc()
+			logger.Error("failed to check if user exists", "email", email, "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			m.LoginAttempts.WithLabelValues("passkey", "unknown_user").Inc()
+			logger.Warn("passkey login for removed user", "email", email)
+			httpError(w, r, "The passkey was not accepted.", http.StatusUnauthorized)
+			return
+		}
+		m.LoginAttempts.WithLabelValues("passkey", "success").Inc()
+
+		claims := authentication.Claims{Email: email, Remember: r.URL.Query().Get("remember") == "on"}
+		next, err := startSession(w, r, auth, twoFactor, claims)
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("logged in via passkey", "user", email, "remember", claims.Remember)
+		writeJSON(w, r, map[string]string{"redirect": next})
+	}
+}
@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// HTTPSRedirectHandler sends plain HTTP requests to the same path on
+// appOrigin, which is expected to be the https:// origin of the server.
+func HTTPSRedirectHandler(appOrigin string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, appOrigin+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+	"github.com/erkannt/rechenschaftspflicht/views"
+	"github.com/julienschmidt/httprouter"
+)
+
+// SessionsHandler lists the user's active sessions.
+func SessionsHandler(sessionStore sessions.SessionStore, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		current, err := auth.CurrentSession(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		active, err := sessionStore.Active(r.Context(), current.Email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to list sessions", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = views.LayoutWithNav(views.Sessions(active, current.ID)).Render(r.Context(), w)
+		if err != nil {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+			return
+		}
+	}
+}
+
+// RevokeSessionHandler ends one of the user's other sessions. Revoking the
+// current session logs out.
+func RevokeSessionHandler(sessionStore sessions.SessionStore, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		current, err := auth.CurrentSession(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		id := r.FormValue("id")
+		if id == current.ID {
+			LogoutHandler(auth)(w, r, ps)
+			return
+		}
+		if err := sessionStore.Revoke(r.Context(), current.Email, id); err != nil {
+			logging.FromContext(r.Context()).Error("failed to revoke session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		logging.FromContext(r.Context()).Info("revoked session", "session_id", id)
+		http.Redirect(w, r, "/sessions", http.StatusFound)
+	}
+}
+
+// RevokeAllSessionsHandler logs the user out everywhere, including here.
+func RevokeAllSessionsHandler(sessionStore sessions.SessionStore, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if err := sessionStore.RevokeAll(r.Context(), email); err != nil {
+			logging.FromContext(r.Context()).Error("failed to revoke sessions", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		// The current session is revoked already, this only clears the cookie.
+		cookie, err := auth.LoggedOut(r)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("failed to clear session cookie", "error", err)
+		}
+		http.SetCookie(w, &cookie)
+
+		logging.FromContext(r.Context()).Info("logged out everywhere")
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/sso"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ssoFlowCookie binds a login through the identity provider to the
+// browser that began it. It has to be Lax, as the provider's redirect back
+// is a cross-site navigation.
+const ssoFlowCookie = "oidc_flow"
+
+// SSOLoginHandler sends the user to the identity provider to log in. It is
+// a GET, as the form-action CSP directive would block a form post that
+// redirects to the provider.
+func SSOLoginHandler(provider *sso.Provider, appOrigin string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		authURL, flow, err := provider.Begin(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to begin login via identity provider", "error", err)
+			httpError(w, r, "Logging in with "+provider.Name()+" is not available right now.", http.StatusBadGateway)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     ssoFlowCookie,
+			Value:    flow.String(),
+			Path:     "/login/oidc",
+			Expires:  time.Now().Add(10 * time.Minute),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(appOrigin, "https"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// SSOCallbackHandler starts a session for the user the identity provider
+// sent back, if their verified email belongs to a user.
+func SSOCallbackHandler(provider *sso.Provider, userStore userstore.UserStore, auth authentication.Auth, twoFactor *twofactor.Service, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+
+		var flow sso.Flow
+		cookie, err := r.Cookie(ssoFlowCookie)
+		if err == nil {
+			flow, err = sso.ParseFlow(cookie.Value)
+		}
+		if err != nil {
+			m.LoginAttempts.WithLabelValues("oidc", "invalid").Inc()
+			logger.Info("identity provider callback without a login in progress")
+			httpError(w, r, "This login has expired, please try again.", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: ssoFlowCookie, Path: "/login/oidc", MaxAge: -1})
+
+		email, err := provider.Finish(r.Context(), flow, r.URL.Query())
+		if err != nil {
+			switch {
+			case errors.Is(err, sso.ErrDenied):
+				m.LoginAttempts.WithLabelValues("oidc", "denied").Inc()
+				logger.Info("identity provider denied login", "error", err)
+				http.Redirect(w, r, "/", http.StatusFound)
+			case errors.Is(err, sso.ErrMismatch):
+				m.LoginAttempts.WithLabelValues("oidc", "invalid").Inc()
+				logger.Warn("identity provider callback doesn't match login", "security_event", "oidc_mismatch", "error", err)
+				httpError(w, r, "This login was started elsewhere or has expired, please try again.", http.StatusBadRequest)
+			case errors.Is(err, sso.ErrUnverifiedEmail):
+				m.LoginAttempts.WithLabelValues("oidc", "unverified").Inc()
+				logger.Info("identity provider didn't verify email", "error", err)
+				httpError(w, r, provider.Name()+" has not verified your email address.", http.StatusForbidden)
+			default:
+				m.LoginAttempts.WithLabelValues("oidc", "error").Inc()
+				logger.Error("failed to finish login via identity provider", "error", err)
+				httpError(w, r, "Logging in with "+provider.Name()+" failed, please try again.", http.StatusBadGateway)
+			}
+			return
+		}
+
+		exists, err := userStore.IsUser(r.Context(), email)
+		if err != nil {
+			m.LoginAttempts.WithLabelValues("oidc", "error").Inc()
+			logger.Error("failed to check if user exists", "email", email, "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			m.LoginAttempts.WithLabelValues("oidc", "unknown_user").Inc()
+			logger.Warn("login via identity provider for unknown email", "email", email)
+			httpError(w, r, "There is no account for "+email+".", http.StatusForbidden)
+			return
+		}
+		m.LoginAttempts.WithLabelValues("oidc", "success").Inc()
+
+		next, err := startSession(w, r, auth, twoFactor, authentication.Claims{Email: email})
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("logged in via identity provider", "user", email)
+		http.Redirect(w, r, next, http.StatusFound)
+	}
+}
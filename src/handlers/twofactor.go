@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
+	"github.com/erkannt/rechenschaftspflicht/views"
+	"github.com/julienschmidt/httprouter"
+)
+
+// startSession logs in the user of claims, who passed the first factor,
+// and returns where to send them next. Users who need a second factor are
+// only partially logged in and sent to enter it.
+func startSession(w http.ResponseWriter, r *http.Request, auth authentication.Auth, twoFactor *twofactor.Service, claims authentication.Claims) (string, error) {
+	status, err := twoFactor.Status(r.Context(), claims.Email)
+	if err != nil {
+		return "", err
+	}
+	if status.Required() {
+		cookie, err := auth.PartiallyLoggedIn(claims)
+		if err != nil {
+			return "", err
+		}
+		http.SetCookie(w, &cookie)
+		logging.FromContext(r.Context()).Info("awaiting second factor", "user", claims.Email, "enrolled", status.Enrolled)
+		return "/login/totp", nil
+	}
+
+	cookie, err := auth.LoggedIn(r, claims)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &cookie)
+	return "/record-event", nil
+}
+
+// render writes page, which is any of the views, with the given status.
+func render(w http.ResponseWriter, r *http.Request, status int, page interface {
+	Render(ctx context.Context, w io.Writer) error
+}) {
+	w.WriteHeader(status)
+	if err := page.Render(r.Context(), w); err != nil {
+		logging.FromContext(r.Context()).Error("failed to render page", "error", err)
+	}
+}
+
+func codeProblem(err error) string {
+	if errors.Is(err, twofactor.ErrReplayed) {
+		return "That code has been used already. Please wait for the next one."
+	}
+	return "That code is not correct."
+}
+
+// LoginTOTPHandler asks a partially logged in user for their second
+// factor, or to set one up if their role requires it and they haven't.
+func LoginTOTPHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		claims, err := auth.PartialLogin(r)
+		if err != nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		status, err := twoFactor.Status(r.Context(), claims.Email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to check second factor", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if status.Enrolled {
+			render(w, r, http.StatusOK, views.LayoutBare(views.LoginTOTP("")))
+			return
+		}
+
+		secret, err := twoFactor.BeginEnrolment(r.Context(), claims.Email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to begin TOTP enrolment", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		render(w, r, http.StatusOK, views.LayoutBare(views.TOTPEnrolment(views.TOTPEnrolmentPage{
+			Secret: secret,
+			QRURL:  "/login/totp/qr.png",
+			Action: "/login/totp/enrol",
+		})))
+	}
+}
+
+// LoginTOTPPostHandler completes a partial login with a code from the
+// user's authenticator app or a recovery code.
+func LoginTOTPPostHandler(twoFactor *twofactor.Service, auth authentication.Auth, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		claims, err := auth.PartialLogin(r)
+		if err != nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		recovery, err := twoFactor.Verify(r.Context(), claims.Email, r.FormValue("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, twofactor.ErrWrongCode), errors.Is(err, twofactor.ErrReplayed):
+				m.LoginAttempts.WithLabelValues("totp", "wrong").Inc()
+				logger.Info("wrong second factor code", "user", claims.Email, "error", err)
+				render(w, r, http.StatusUnprocessableEntity, views.LayoutBare(views.LoginTOTP(codeProblem(err))))
+			case errors.Is(err, twofactor.ErrNotFound):
+				// Users who must use a second factor but haven't set one
+				// up yet do so first.
+				http.Redirect(w, r, "/login/totp", http.StatusFound)
+			default:
+				m.LoginAttempts.WithLabelValues("totp", "error").Inc()
+				logger.Error("failed to check second factor", "error", err)
+				httpError(w, r, "internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		m.LoginAttempts.WithLabelValues("totp", "success").Inc()
+		if recovery {
+			logger.Warn("logged in with recovery code", "security_event", "recovery_code_used", "user", claims.Email)
+		}
+
+		cookie, err := auth.LoggedIn(r, claims)
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &cookie)
+		partial := auth.ClearPartialLogin()
+		http.SetCookie(w, &partial)
+
+		logger.Info("logged in with second factor", "user", claims.Email)
+		http.Redirect(w, r, "/record-event", http.StatusFound)
+	}
+}
+
+// LoginTOTPEnrolHandler completes a partial login by confirming the
+// second factor the user was made to set up, and shows their recovery
+// codes.
+func LoginTOTPEnrolHandler(twoFactor *twofactor.Service, auth authentication.Auth, m *metrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		claims, err := auth.PartialLogin(r)
+		if err != nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		enrolled, err := enrolledDuringLogin(r, twoFactor, claims.Email)
+		if err != nil {
+			logger.Error("failed to check second factor", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if enrolled {
+			httpError(w, r, "You have set up two-factor authentication already. Please enter a code from your app.", http.StatusForbidden)
+			return
+		}
+		codes, ok := confirmEnrolment(w, r, twoFactor, claims.Email, "/login/totp/qr.png", "/login/totp/enrol")
+		if !ok {
+			m.LoginAttempts.WithLabelValues("totp", "wrong").Inc()
+			return
+		}
+		m.LoginAttempts.WithLabelValues("totp", "enrolled").Inc()
+
+		cookie, err := auth.LoggedIn(r, claims)
+		if err != nil {
+			logger.Error("failed to start session", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &cookie)
+		partial := auth.ClearPartialLogin()
+		http.SetCookie(w, &partial)
+
+		logger.Info("logged in after setting up second factor", "user", claims.Email)
+		render(w, r, http.StatusOK, views.LayoutBare(views.RecoveryCodes(codes, "/record-event")))
+	}
+}
+
+// enrolledDuringLogin reports whether a partially logged in user has a
+// second factor already. They must enter it rather than set up another, so
+// that a replacement they began from /two-factor can't be read or
+// confirmed with the first factor alone.
+func enrolledDuringLogin(r *http.Request, twoFactor *twofactor.Service, email string) (bool, error) {
+	status, err := twoFactor.Status(r.Context(), email)
+	if err != nil {
+		return false, err
+	}
+	if status.Enrolled {
+		logging.FromContext(r.Context()).Warn("refused second factor setup during login", "security_event", "totp_enrolment_refused", "user", email)
+	}
+	return status.Enrolled, nil
+}
+
+// confirmEnrolment confirms the user's pending secret with the submitted
+// code. If that fails, it has responded already.
+func confirmEnrolment(w http.ResponseWriter, r *http.Request, twoFactor *twofactor.Service, email, qrURL, action string) ([]string, bool) {
+	logger := logging.FromContext(r.Context())
+	codes, err := twoFactor.ConfirmEnrolment(r.Context(), email, r.FormValue("code"))
+	switch {
+	case err == nil:
+		logger.Info("set up second factor", "user", email)
+		return codes, true
+	case errors.Is(err, twofactor.ErrWrongCode):
+		secret, err := twoFactor.PendingSecret(r.Context(), email)
+		if err != nil {
+			logger.Error("failed to get pending TOTP secret", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return nil, false
+		}
+		render(w, r, http.StatusUnprocessableEntity, views.LayoutBare(views.TOTPEnrolment(views.TOTPEnrolmentPage{
+			Secret:  secret,
+			QRURL:   qrURL,
+			Action:  action,
+			Problem: codeProblem(err),
+		})))
+	case errors.Is(err, twofactor.ErrNotFound):
+		httpError(w, r, "There is no setup in progress, please start again.", http.StatusBadRequest)
+	default:
+		logger.Error("failed to confirm TOTP enrolment", "error", err)
+		httpError(w, r, "internal server error", http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+func writeEnrolmentQR(w http.ResponseWriter, r *http.Request, twoFactor *twofactor.Service, email string) {
+	png, err := twoFactor.EnrolmentQR(r.Context(), email)
+	if errors.Is(err, twofactor.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to render QR code", "error", err)
+		httpError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(png)
+}
+
+// LoginTOTPQRHandler serves the QR code for setting up a second factor
+// during a partial login.
+func LoginTOTPQRHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		claims, err := auth.PartialLogin(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		enrolled, err := enrolledDuringLogin(r, twoFactor, claims.Email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to check second factor", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if enrolled {
+			http.NotFound(w, r)
+			return
+		}
+		writeEnrolmentQR(w, r, twoFactor, claims.Email)
+	}
+}
+
+// TwoFactorHandler shows the logged in user's second factor settings.
+func TwoFactorHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		status, err := twoFactor.Status(r.Context(), email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to check second factor", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		render(w, r, http.StatusOK, views.LayoutWithNav(views.TwoFactor(status, "")))
+	}
+}
+
+// TwoFactorEnrolHandler starts setting up a second factor, or replacing
+// the current one.
+func TwoFactorEnrolHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		secret, err := twoFactor.BeginEnrolment(r.Context(), email)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to begin TOTP enrolment", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		render(w, r, http.StatusOK, views.LayoutWithNav(views.TOTPEnrolment(views.TOTPEnrolmentPage{
+			Secret: secret,
+			QRURL:  "/two-factor/qr.png",
+			Action: "/two-factor/confirm",
+		})))
+	}
+}
+
+// TwoFactorConfirmHandler finishes setting up a second factor and shows
+// the new recovery codes.
+func TwoFactorConfirmHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		codes, ok := confirmEnrolment(w, r, twoFactor, email, "/two-factor/qr.png", "/two-factor/confirm")
+		if !ok {
+			return
+		}
+		render(w, r, http.StatusOK, views.LayoutWithNav(views.RecoveryCodes(codes, "/two-factor")))
+	}
+}
+
+// TwoFactorQRHandler serves the QR code for setting up a second factor.
+func TwoFactorQRHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeEnrolmentQR(w, r, twoFactor, email)
+	}
+}
+
+// TwoFactorDisableHandler turns off the user's second factor, after they
+// prove they still have it.
+func TwoFactorDisableHandler(twoFactor *twofactor.Service, auth authentication.Auth) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger := logging.FromContext(r.Context())
+		email, err := auth.GetLoggedInUserEmail(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		_, err = twoFactor.Verify(r.Context(), email, r.FormValue("code"))
+		if errors.Is(err, twofactor.ErrWrongCode) || errors.Is(err, twofactor.ErrReplayed) {
+			status, statusErr := twoFactor.Status(r.Context(), email)
+			if statusErr != nil {
+				logger.Error("failed to check second factor", "error", statusErr)
+				httpError(w, r, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			render(w, r, http.StatusUnprocessableEntity, views.LayoutWithNav(views.TwoFactor(status, codeProblem(err))))
+			return
+		}
+		if err == nil {
+			err = twoFactor.Disable(r.Context(), email)
+		}
+		if errors.Is(err, twofactor.ErrRequired) {
+			httpError(w, r, "Your role requires two-factor authentication.", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to disable second factor", "error", err)
+			httpError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("turned off second factor", "security_event", "second_factor_disabled", "user", email)
+		http.Redirect(w, r, "/two-factor", http.StatusFound)
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/pquerna/otp/totp"
+)
+
+const admin = "admin@example.com"
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// partialLogin returns the cookie of a user who passed only the first
+// factor.
+func (e *testEnv) partialLogin(t *testing.T, email string) *http.Cookie {
+	t.Helper()
+	cookie, err := e.auth.PartiallyLoggedIn(authentication.Claims{ID: "link", Email: email})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &cookie
+}
+
+func TestLoginTOTPEnrol(t *testing.T) {
+	e := newTestEnv(t, userstore.RoleAdmin)
+	e.addUser(t, admin, userstore.RoleAdmin)
+	partial := e.partialLogin(t, admin)
+
+	r := httptest.NewRequest(http.MethodGet, "/login/totp", nil)
+	r.AddCookie(partial)
+	w := httptest.NewRecorder()
+	LoginTOTPHandler(e.twoFactor, e.auth)(w, r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected enrolment page, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/login/totp/qr.png", nil)
+	r.AddCookie(partial)
+	w = httptest.NewRecorder()
+	LoginTOTPQRHandler(e.twoFactor, e.auth)(w, r, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected QR code, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	secret, err := e.twoFactor.PendingSecret(context.Background(), admin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w = postForm(LoginTOTPEnrolHandler(e.twoFactor, e.auth, e.m), "/login/totp/enrol", url.Values{"code": {totpCode(t, secret, time.Now())}}, partial)
+	if w.Code != http.StatusOK || responseCookie(w, "auth") == nil {
+		t.Errorf("expected to be logged in after enrolling, got %d", w.Code)
+	}
+}
+
+func TestLoginTOTPEnrolRefusedWhenEnrolled(t *testing.T) {
+	e := newTestEnv(t, userstore.RoleAdmin)
+	e.addUser(t, admin, userstore.RoleAdmin)
+	ctx := context.Background()
+
+	secret, err := e.twoFactor.BeginEnrolment(ctx, admin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	codes, err := e.twoFactor.ConfirmEnrolment(ctx, admin, totpCode(t, secret, time.Now().Add(-30*time.Second)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The victim begins replacing their second factor while logged in.
+	pending, err := e.twoFactor.BeginEnrolment(ctx, admin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Someone with only the first factor must not see or confirm it.
+	partial := e.partialLogin(t, admin)
+	r := httptest.NewRequest(http.MethodGet, "/login/totp/qr.png", nil)
+	r.AddCookie(partial)
+	w := httptest.NewRecorder()
+	LoginTOTPQRHandler(e.twoFactor, e.auth)(w, r, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for the QR code, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = postForm(LoginTOTPEnrolHandler(e.twoFactor, e.auth, e.m), "/login/totp/enrol", url.Values{"code": {totpCode(t, pending, time.Now())}}, partial)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d for confirming, got %d", http.StatusForbidden, w.Code)
+	}
+	if responseCookie(w, "auth") != nil {
+		t.Error("expected no session")
+	}
+
+	// The original second factor and recovery codes still work.
+	if _, err := e.twoFactor.Verify(ctx, admin, totpCode(t, secret, time.Now())); err != nil {
+		t.Errorf("expected original secret to work, got %v", err)
+	}
+	if recovery, err := e.twoFactor.Verify(ctx, admin, codes[0]); err != nil || !recovery {
+		t.Errorf("expected original recovery code to work, got %v, %v", recovery, err)
+	}
+}
+
+func TestLoginTOTPSendsUnenrolledUsersToEnrolment(t *testing.T) {
+	e := newTestEnv(t, userstore.RoleAdmin)
+	e.addUser(t, admin, userstore.RoleAdmin)
+
+	w := postForm(LoginTOTPPostHandler(e.twoFactor, e.auth, e.m), "/login/totp", url.Values{"code": {"123456"}}, e.partialLogin(t, admin))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login/totp" {
+		t.Errorf("expected redirect to /login/totp, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,59 +13,204 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/erkannt/rechenschaftspflicht/handlers"
 	"github.com/erkannt/rechenschaftspflicht/middlewares"
+	"github.com/erkannt/rechenschaftspflicht/services/admintokens"
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
 	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/certreloader"
 	"github.com/erkannt/rechenschaftspflicht/services/config"
 	database "github.com/erkannt/rechenschaftspflicht/services/db"
 	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/feedtokens"
+	"github.com/erkannt/rechenschaftspflicht/services/keyring"
+	"github.com/erkannt/rechenschaftspflicht/services/listener"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/magiclinks"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/passkeys"
+	"github.com/erkannt/rechenschaftspflicht/services/ratelimit"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+	"github.com/erkannt/rechenschaftspflicht/services/sso"
+	"github.com/erkannt/rechenschaftspflicht/services/tracing"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
 	"github.com/erkannt/rechenschaftspflicht/services/userstore"
 	"github.com/julienschmidt/httprouter"
 	sloghttp "github.com/samber/slog-http"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+const usage = `usage:
+  rechenschaftspflicht                            run the server
+  rechenschaftspflicht config print               show the effective config, secrets masked
+  rechenschaftspflicht keys list                  show the IDs of the signing keys
+  rechenschaftspflicht keys generate              print a new signing key for JWT_KEYS
+  rechenschaftspflicht admin-tokens list          show the names of the admin tokens
+  rechenschaftspflicht admin-tokens generate NAME print a new admin token for ADMIN_TOKENS
+
+To rotate the signing key, put a generated key first in JWT_KEYS and keep
+the previous ones after it until the tokens they signed have expired.
+
+To rotate an admin token, add a generated one to ADMIN_TOKENS, switch
+clients over to it and then remove the old one.`
+
 func run(
 	ctx context.Context,
+	args []string,
 	stdout io.Writer,
 	getenv func(string) string,
 ) error {
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Generating a key must work before there is a valid config.
+	if len(args) == 3 && args[1] == "keys" && args[2] == "generate" {
+		key, err := keyring.Generate()
+		if err != nil {
+			return fmt.Errorf("could not generate key: %w", err)
+		}
+		_, err = fmt.Fprintln(stdout, key)
+		return err
+	}
+
+	if len(args) == 4 && args[1] == "admin-tokens" && args[2] == "generate" {
+		return generateAdminToken(stdout, args[3])
+	}
+
+	switch {
+	case len(args) <= 1:
+	case len(args) == 3 && args[1] == "config" && args[2] == "print":
+		return printConfig(stdout, getenv)
+	case len(args) == 3 && args[1] == "keys" && args[2] == "list":
+	case len(args) == 3 && args[1] == "admin-tokens" && args[2] == "list":
+	default:
+		return errors.New(usage)
+	}
+
 	// Setup dependencies
-	logger := slog.New(slog.NewJSONHandler(stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cfg, err := config.Load(getenv)
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
 
-	cfg, err := config.LoadFromEnv(getenv)
+	if len(args) == 3 && args[2] == "list" {
+		if args[1] == "keys" {
+			return listKeys(stdout, cfg)
+		}
+		return listAdminTokens(stdout, cfg)
+	}
+
+	logger, err := logging.New(stdout, cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
-		return fmt.Errorf("could not load config from env: %w", err)
+		return fmt.Errorf("could not create logger: %w", err)
 	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.OTLPEndpoint)
+	if err != nil {
+		return fmt.Errorf("could not set up tracing: %w", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}()
 
 	db, err := database.InitDB(cfg)
 	if err != nil {
 		return fmt.Errorf("could not init database: %w", err)
 	}
 
-	eventStore := eventstore.NewEventStore(db)
-	userStore := userstore.NewUserStore(db)
-	auth := authentication.New(logger, cfg)
+	m := metrics.New()
+	eventStore := metrics.InstrumentEventStore(tracing.TraceEventStore(eventstore.NewEventStore(db)), m)
+	userStore := metrics.InstrumentUserStore(tracing.TraceUserStore(userstore.NewUserStore(db)), m)
+	feedTokens := metrics.InstrumentFeedTokenStore(feedtokens.NewFeedTokenStore(db), m)
+	magicLinks := metrics.InstrumentMagicLinkStore(magiclinks.NewMagicLinkStore(db), m)
+	apiTokens := metrics.InstrumentAPITokenStore(apitokens.NewAPITokenStore(db), m)
+	sessionStore := metrics.InstrumentSessionStore(sessions.NewSessionStore(db), m)
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return fmt.Errorf("could not load signing keys: %w", err)
+	}
+	passkeyService, err := passkeys.New(cfg.AppOrigin, metrics.InstrumentPasskeyStore(passkeys.NewPasskeyStore(db), m))
+	if err != nil {
+		return fmt.Errorf("could not set up passkeys: %w", err)
+	}
+	var ssoProvider *sso.Provider
+	if cfg.OIDCEnabled() {
+		ssoProvider = sso.New(cfg.OIDCProviderName, cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.AppOrigin+"/login/oidc/callback")
+	}
+	twoFactor := twofactor.New("Rechenschaftspflicht", metrics.InstrumentTwoFactorStore(twofactor.NewTwoFactorStore(db), m), userStore, cfg.TOTPRequiredRoles)
+	auth := metrics.InstrumentAuth(tracing.TraceAuth(authentication.New(logger, cfg, keys, sessionStore)), m)
+	adminTokens, err := cfg.AdminTokenSet()
+	if err != nil {
+		return fmt.Errorf("could not load admin tokens: %w", err)
+	}
+	clientIPs, err := cfg.ClientIPs()
+	if err != nil {
+		return fmt.Errorf("could not load trusted proxies: %w", err)
+	}
 
 	// Create server
 	router := httprouter.New()
-	addRoutes(router, cfg, eventStore, userStore, auth)
+	bearerRoutes := addRoutes(instrumentedRouter{Router: router, m: m}, cfg, db, eventStore, userStore, feedTokens, magicLinks, apiTokens, sessionStore, passkeyService, ssoProvider, twoFactor, auth, adminTokens, clientIPs, ratelimit.NewMemoryStore(), m)
 	requestLogging := sloghttp.New(logger)
-	handlerWithMiddlewares := middlewares.SecurityHeaders(requestLogging(router))
+	csrfProtection := middlewares.CSRF(cfg.AppOrigin, bearerRoutes, http.HandlerFunc(handlers.CSRFFailureHandler))
+	handlerWithMiddlewares := middlewares.SecurityHeaders(middlewares.RequestID(requestLogging(middlewares.RequestLogger(logger)(csrfProtection(router)))))
+	handlerWithMiddlewares = otelhttp.NewHandler(handlerWithMiddlewares, "http.server")
+
+	srv := &http.Server{Handler: handlerWithMiddlewares}
+	if cfg.TLSEnabled() {
+		certs, err := certreloader.New(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		if err := certs.Watch(ctx, logger); err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
 
-	srv := &http.Server{Addr: ":8080", Handler: handlerWithMiddlewares}
+	ln, err := listener.Listen(cfg.ListenAddr, cfg.SocketMode, getenv)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", cfg.ListenAddr, err)
+	}
 
 	// Start the server
-	serverErr := make(chan error, 1)
+	serverErr := make(chan error, 2)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			serverErr <- err
 		} else {
 			serverErr <- nil
 		}
 	}()
-	logger.Info("Server is listening on :8080")
+	logger.Info("Server is listening", "addr", ln.Addr().String(), "tls", srv.TLSConfig != nil)
+
+	var redirectSrv *http.Server
+	if cfg.HTTPRedirectAddr != "" {
+		redirectSrv = &http.Server{
+			Addr:    cfg.HTTPRedirectAddr,
+			Handler: handlers.HTTPSRedirectHandler(cfg.AppOrigin),
+		}
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("http redirect: %w", err)
+			}
+		}()
+		logger.Info("Redirecting plain HTTP to HTTPS", "addr", cfg.HTTPRedirectAddr)
+	}
 
 	// Graceful shutdown
 	select {
@@ -71,6 +218,9 @@ func run(
 		logger.Info("Shutting down server...")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		if redirectSrv != nil {
+			_ = redirectSrv.Shutdown(shutdownCtx)
+		}
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			return fmt.Errorf("server forced to shutdown: %w", err)
 		}
@@ -85,9 +235,72 @@ func run(
 	}
 }
 
+// printConfig shows the config even if it is invalid, as that is when it
+// is most needed, and reports its problems afterwards.
+func printConfig(w io.Writer, getenv func(string) string) error {
+	cfg, err := config.Read(getenv)
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+	if err := cfg.Print(w); err != nil {
+		return err
+	}
+	if err := cfg.Valid().Err(); err != nil {
+		return fmt.Errorf("config is invalid: %w", err)
+	}
+	return nil
+}
+
+// listKeys prints the configured key IDs, marking the one that signs new
+// tokens.
+func listKeys(w io.Writer, cfg config.Config) error {
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return err
+	}
+	for _, id := range keys.IDs() {
+		marker := ""
+		if id == keys.Active().ID {
+			marker = " (active)"
+		}
+		if _, err := fmt.Fprintf(w, "%s%s\n", id, marker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listAdminTokens(w io.Writer, cfg config.Config) error {
+	tokens, err := cfg.AdminTokenSet()
+	if err != nil {
+		return err
+	}
+	for _, name := range tokens.Names() {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateAdminToken prints a new token for the client and the entry
+// configuring it by its hash, so the token itself needn't be stored.
+func generateAdminToken(w io.Writer, name string) error {
+	token, err := admintokens.Generate()
+	if err != nil {
+		return fmt.Errorf("could not generate token: %w", err)
+	}
+	entry := name + ":" + admintokens.Hash(token)
+	if _, err := admintokens.New([]string{entry}, ""); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "token: %s\nADMIN_TOKENS entry: %s\n", token, entry)
+	return err
+}
+
 func main() {
 	ctx := context.Background()
-	if err := run(ctx, os.Stdout, os.Getenv); err != nil {
+	if err := run(ctx, os.Args, os.Stdout, os.Getenv); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
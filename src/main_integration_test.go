@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/erkannt/rechenschaftspflicht/services/csrf"
 	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -98,7 +99,7 @@ func TestIntegrationHappyPath(t *testing.T) {
 	// Start the application in a goroutine
 	serverErr := make(chan error, 1)
 	go func() {
-		serverErr <- run(ctx, &serverLogs, getenv)
+		serverErr <- run(ctx, []string{"rechenschaftspflicht"}, &serverLogs, getenv)
 	}()
 
 	// Print logs if test fails
@@ -155,6 +156,7 @@ func TestIntegrationHappyPath(t *testing.T) {
 		// Request magic link
 		formData := url.Values{}
 		formData.Set("email", testEmail)
+		formData.Set(csrf.FieldName, csrfToken(t, client, serverAddr))
 
 		resp, err := client.PostForm(fmt.Sprintf("http://%s/login", serverAddr), formData)
 		if err != nil {
@@ -175,11 +177,24 @@ func TestIntegrationHappyPath(t *testing.T) {
 			t.Fatalf("could not extract token from magic link")
 		}
 
-		// Visit magic link to set auth cookie and follow redirect
+		// Visit magic link, which only asks to confirm the login
 		resp, err = client.Get(fmt.Sprintf("http://%s/login?token=%s", serverAddr, token))
 		if err != nil {
 			t.Fatalf("failed to visit magic link: %v", err)
 		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/login" {
+			t.Fatalf("expected the login confirmation, got %d %s", resp.StatusCode, resp.Request.URL.Path)
+		}
+
+		// Confirm to set auth cookie and follow redirect
+		resp, err = client.PostForm(fmt.Sprintf("http://%s/login/link", serverAddr), url.Values{
+			"token":        {token},
+			csrf.FieldName: {csrfToken(t, client, serverAddr)},
+		})
+		if err != nil {
+			t.Fatalf("failed to confirm login: %v", err)
+		}
 		defer func() { _ = resp.Body.Close() }()
 
 		// Check if we ended up on the record-event page (successful login)
@@ -212,6 +227,7 @@ func TestIntegrationHappyPath(t *testing.T) {
 			formData.Set("tag", event.tag)
 			formData.Set("value", event.value)
 			formData.Set("comment", event.comment)
+			formData.Set(csrf.FieldName, csrfToken(t, client, serverAddr))
 
 			resp, err := client.PostForm(fmt.Sprintf("http://%s/record-event", serverAddr), formData)
 			if err != nil {
@@ -451,6 +467,27 @@ func getMagicLinkFromMailpit(host, apiPort, toEmail string) (string, error) {
 	return "", fmt.Errorf("magic link email not found after %v", timeout)
 }
 
+// csrfToken returns the CSRF token from the client's cookie jar, visiting
+// the landing page first if the server hasn't set one yet.
+func csrfToken(t *testing.T, client *http.Client, serverAddr string) string {
+	t.Helper()
+	u, _ := url.Parse(fmt.Sprintf("http://%s/", serverAddr))
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, cookie := range client.Jar.Cookies(u) {
+			if cookie.Name == csrf.CookieName {
+				return cookie.Value
+			}
+		}
+		resp, err := client.Get(u.String())
+		if err != nil {
+			t.Fatalf("failed to fetch CSRF token: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+	t.Fatal("server did not set a CSRF cookie")
+	return ""
+}
+
 // extractTokenFromURL extracts the token parameter from a URL
 func extractTokenFromURL(magicLink string) string {
 	u, err := url.Parse(magicLink)
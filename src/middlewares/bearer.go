@@ -4,30 +4,61 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/erkannt/rechenschaftspflicht/services/admintokens"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/ratelimit"
 	"github.com/julienschmidt/httprouter"
 )
 
-func RequireBearerToken(bearerToken string) func(httprouter.Handle) httprouter.Handle {
+// parseBearerToken extracts the token from an "Authorization: Bearer" header.
+func parseBearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", false
+	}
+
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// RequireBearerToken only lets requests through that carry one of the
+// admin tokens as their bearer token. Failed attempts are logged and
+// counted per client address, as keyed by clientIP, by limiter; while it
+// blocks an address, requests from it are rejected without checking their
+// token.
+func RequireBearerToken(tokens *admintokens.Tokens, limiter *ratelimit.Limiter, clientIP func(*http.Request) string) func(httprouter.Handle) httprouter.Handle {
 	return func(h httprouter.Handle) httprouter.Handle {
 		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
+			logger := logging.FromContext(r.Context())
+			ip := clientIP(r)
 
-			parts := strings.SplitN(authHeader, " ", 2)
-			if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
-				w.WriteHeader(http.StatusUnauthorized)
+			retryAfter, err := limiter.Blocked(r.Context(), ip)
+			if err != nil {
+				logger.Error("rate limiter failed", "limit", limiter.Name(), "error", err)
+			} else if retryAfter > 0 {
+				tooManyRequests(w, r, limiter, ip, retryAfter)
 				return
 			}
 
-			if parts[1] != bearerToken {
+			token, ok := parseBearerToken(r)
+			name := ""
+			if ok {
+				name, ok = tokens.Match(token)
+			}
+			if !ok {
+				logger.Warn("rejected admin token", "security_event", "admin_token_rejected", "client_ip", ip)
+				if _, _, err := limiter.Allow(r.Context(), ip); err != nil {
+					logger.Error("rate limiter failed", "limit", limiter.Name(), "error", err)
+				}
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			h(w, r, ps)
+			logger = logger.With("admin_token", name)
+			h(w, r.WithContext(logging.WithLogger(r.Context(), logger)), ps)
 		}
 	}
 }
@@ -0,0 +1,102 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/admintokens"
+	"github.com/erkannt/rechenschaftspflicht/services/clientip"
+	"github.com/erkannt/rechenschaftspflicht/services/ratelimit"
+	"github.com/julienschmidt/httprouter"
+)
+
+func newBearerTestHandler(t *testing.T) httprouter.Handle {
+	t.Helper()
+	tokens, err := admintokens.New([]string{"ci:valid-token"}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	limiter := ratelimit.New("admin_token_ip", ratelimit.NewMemoryStore(), ratelimit.Policy{
+		Burst:     3,
+		Window:    time.Hour,
+		BaseDelay: time.Minute,
+		MaxDelay:  time.Hour,
+	})
+	clientIPs, err := clientip.New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return RequireBearerToken(tokens, limiter, ByClientIP(clientIPs))(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// serveBearer sends a request from client through the trusted proxy.
+func serveBearer(h httprouter.Handle, client, authorization string) int {
+	r := httptest.NewRequest(http.MethodPost, "/add-user", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", client)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	h(w, r, nil)
+	return w.Code
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	h := newBearerTestHandler(t)
+
+	cases := map[string]int{
+		"Bearer valid-token": http.StatusNoContent,
+		"bearer valid-token": http.StatusNoContent,
+		"Bearer wrong":       http.StatusUnauthorized,
+		"Basic valid-token":  http.StatusUnauthorized,
+		"":                   http.StatusUnauthorized,
+	}
+	for authorization, want := range cases {
+		if got := serveBearer(h, "192.0.2.1", authorization); got != want {
+			t.Errorf("%q: expected %d, got %d", authorization, want, got)
+		}
+	}
+}
+
+func TestRequireBearerTokenBlocksAfterFailures(t *testing.T) {
+	h := newBearerTestHandler(t)
+
+	// Valid tokens don't count towards the limit.
+	for range 5 {
+		if got := serveBearer(h, "192.0.2.1", "Bearer valid-token"); got != http.StatusNoContent {
+			t.Fatalf("expected %d, got %d", http.StatusNoContent, got)
+		}
+	}
+	for range 3 {
+		if got := serveBearer(h, "192.0.2.1", "Bearer wrong"); got != http.StatusUnauthorized {
+			t.Fatalf("expected %d, got %d", http.StatusUnauthorized, got)
+		}
+	}
+	if got := serveBearer(h, "192.0.2.1", "Bearer wrong"); got != http.StatusTooManyRequests {
+		t.Errorf("expected %d once blocked, got %d", http.StatusTooManyRequests, got)
+	}
+
+	// A blocked address gets no answer as to whether a token is valid.
+	if got := serveBearer(h, "192.0.2.1", "Bearer valid-token"); got != http.StatusTooManyRequests {
+		t.Errorf("expected %d for a valid token while blocked, got %d", http.StatusTooManyRequests, got)
+	}
+}
+
+func TestRequireBearerTokenBlocksClientsBehindProxy(t *testing.T) {
+	h := newBearerTestHandler(t)
+
+	for range 3 {
+		serveBearer(h, "192.0.2.1", "Bearer wrong")
+	}
+	if got := serveBearer(h, "192.0.2.1", "Bearer wrong"); got != http.StatusTooManyRequests {
+		t.Errorf("expected %d once blocked, got %d", http.StatusTooManyRequests, got)
+	}
+	if got := serveBearer(h, "192.0.2.2", "Bearer wrong"); got != http.StatusUnauthorized {
+		t.Errorf("expected other clients behind the proxy not to be blocked, got %d", got)
+	}
+}
@@ -0,0 +1,61 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/erkannt/rechenschaftspflicht/services/csrf"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+)
+
+// CSRF gives every request a token for the forms it renders and passes
+// state-changing requests to forbidden unless they echo it and come from
+// appOrigin. Requests with a bearer token to routes for which bearerRoutes
+// reports true are API calls, which don't rely on cookies and are exempt.
+// Browsers can attach other credentials, such as basic auth, on their own,
+// so those aren't.
+func CSRF(appOrigin string, bearerRoutes func(*http.Request) bool, forbidden http.Handler) func(http.Handler) http.Handler {
+	secure := strings.HasPrefix(appOrigin, "https")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var token string
+			if cookie, err := r.Cookie(csrf.CookieName); err == nil {
+				token = cookie.Value
+			}
+
+			_, hasBearerToken := parseBearerToken(r)
+			if !csrf.Safe(r.Method) && !(hasBearerToken && bearerRoutes(r)) {
+				if err := csrf.Verify(r, appOrigin, token); err != nil {
+					logging.FromContext(r.Context()).Warn("rejected cross-site request",
+						"security_event", "csrf",
+						"error", err,
+						"origin", r.Header.Get("Origin"),
+						"referer", r.Referer(),
+					)
+					forbidden.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if token == "" {
+				var err error
+				if token, err = csrf.New(); err != nil {
+					logging.FromContext(r.Context()).Error("failed to generate CSRF token", "error", err)
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrf.CookieName,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   secure,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			next.ServeHTTP(w, r.WithContext(csrf.WithToken(r.Context(), token)))
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFExemptsOnlyBearerTokensOnBearerRoutes(t *testing.T) {
+	bearerRoutes := func(r *http.Request) bool { return r.URL.Path == "/add-user" }
+	forbidden := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	h := CSRF("http://localhost:8080", bearerRoutes, forbidden)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		path          string
+		authorization string
+		want          int
+	}{
+		{"/add-user", "Bearer token", http.StatusNoContent},
+		{"/add-user", "Basic dXNlcjpwYXNz", http.StatusForbidden},
+		{"/add-user", "", http.StatusForbidden},
+		{"/record-event", "Bearer token", http.StatusForbidden},
+		{"/record-event", "Basic dXNlcjpwYXNz", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s with %q: expected %d, got %d", tc.path, tc.authorization, tc.want, w.Code)
+		}
+	}
+}
@@ -4,7 +4,8 @@ import (
 	"net/http"
 )
 
-// SecurityHeaders adds security headers to all HTTP responses
+// SecurityHeaders adds security headers to all HTTP responses, and HSTS to
+// those served over TLS.
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Content Security Policy
@@ -32,6 +33,12 @@ func SecurityHeaders(next http.Handler) http.Handler {
 		// Referrer Policy
 		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
 
+		// Only send HSTS over TLS, browsers ignore it on plain HTTP anyway.
+		// It leaves out subdomains, which may well be served by others.
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000")
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Instrument records the duration and status code of requests to route.
+// It is applied per route as httprouter doesn't expose the matched route
+// pattern to outer middlewares.
+func Instrument(m *metrics.Metrics, route string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			h(rec, r, ps)
+
+			m.HTTPRequestDuration.
+				WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).
+				Observe(time.Since(start).Seconds())
+		}
+	}
+}
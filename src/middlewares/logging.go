@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/requestid"
+	"github.com/julienschmidt/httprouter"
+	sloghttp "github.com/samber/slog-http"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestLogger puts a logger tagged with the request and trace IDs into
+// the request context. It must run inside RequestID, which assigns the ID,
+// and inside the tracing handler.
+func RequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := logger.With("request_id", requestid.FromContext(r.Context()))
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				l = l.With("trace_id", sc.TraceID().String())
+			}
+			ctx := logging.WithLogger(r.Context(), l)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// WithRoute tags the request's logs, including the access log line, with
+// the matched route pattern.
+func WithRoute(route string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			sloghttp.AddCustomAttributes(r, slog.String("route", route))
+			h(w, r.WithContext(logging.With(r.Context(), "route", route)), ps)
+		}
+	}
+}
@@ -1,20 +1,34 @@
 package middlewares
 
 import (
+	"log/slog"
 	"net/http"
 
 	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
 	"github.com/julienschmidt/httprouter"
+	sloghttp "github.com/samber/slog-http"
 )
 
 func MustBeLoggedIn(auth authentication.Auth) func(httprouter.Handle) httprouter.Handle {
 	return func(h httprouter.Handle) httprouter.Handle {
 		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			if !auth.IsLoggedIn(r) {
+			// Keep active sessions alive
+			email, cookie, err := auth.RefreshSession(r)
+			if email == "" {
 				http.Redirect(w, r, "/login", http.StatusFound)
 				return
 			}
-			h(w, r, ps)
+			sloghttp.AddCustomAttributes(r, slog.String("user", email))
+			ctx := logging.With(r.Context(), "user", email)
+
+			if err != nil {
+				logging.FromContext(ctx).Warn("failed to refresh session", "error", err)
+			} else if cookie != nil {
+				http.SetCookie(w, cookie)
+			}
+
+			h(w, r.WithContext(ctx), ps)
 		}
 	}
 }
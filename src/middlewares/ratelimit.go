@@ -0,0 +1,64 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/clientip"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/erkannt/rechenschaftspflicht/services/ratelimit"
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimit rejects requests with 429 Too Many Requests while limiter
+// blocks their key. Requests for which key returns "" are not limited. If
+// the limiter fails, requests are let through rather than locking
+// everyone out.
+func RateLimit(limiter *ratelimit.Limiter, key func(*http.Request) string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			k := key(r)
+			if k == "" {
+				h(w, r, ps)
+				return
+			}
+
+			ok, retryAfter, err := limiter.Allow(r.Context(), k)
+			if err != nil {
+				logging.FromContext(r.Context()).Error("rate limiter failed", "limit", limiter.Name(), "error", err)
+			} else if !ok {
+				tooManyRequests(w, r, limiter, k, retryAfter)
+				return
+			}
+
+			h(w, r, ps)
+		}
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, key string, retryAfter time.Duration) {
+	logging.FromContext(r.Context()).Warn("rate limited",
+		"security_event", "rate_limit_lockout",
+		"limit", limiter.Name(),
+		"key", key,
+		"retry_after", retryAfter.String(),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests, please try again later", http.StatusTooManyRequests)
+}
+
+// ByClientIP keys requests by the address they come from, looking past
+// trusted proxies.
+func ByClientIP(clientIPs *clientip.Resolver) func(*http.Request) string {
+	return clientIPs.ClientIP
+}
+
+// ByFormValue keys requests by a form field, case-insensitively.
+func ByFormValue(field string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		return strings.ToLower(strings.TrimSpace(r.FormValue(field)))
+	}
+}
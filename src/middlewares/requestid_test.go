@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/requestid"
+)
+
+// serveRequestID returns the ID the handler saw in its context and the ID
+// echoed in the response.
+func serveRequestID(t *testing.T, incoming string) (string, string) {
+	t.Helper()
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestid.FromContext(r.Context())
+		if got := r.Header.Get(requestid.Header); got != seen {
+			t.Errorf("expected request header %q to match context %q", got, seen)
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if incoming != "" {
+		r.Header.Set(requestid.Header, incoming)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return seen, w.Header().Get(requestid.Header)
+}
+
+func TestRequestIDAcceptsValidID(t *testing.T) {
+	seen, echoed := serveRequestID(t, "from-proxy.42")
+	if seen != "from-proxy.42" || echoed != "from-proxy.42" {
+		t.Errorf("expected the incoming ID to be kept, got %q in context and %q in response", seen, echoed)
+	}
+}
+
+func TestRequestIDReplacesInvalidID(t *testing.T) {
+	for _, incoming := range []string{"", "bad id", "evil\r\nSet-Cookie: x=y"} {
+		seen, echoed := serveRequestID(t, incoming)
+		if seen == incoming || !requestid.Valid(seen) {
+			t.Errorf("%q: expected a new valid ID, got %q", incoming, seen)
+		}
+		if echoed != seen {
+			t.Errorf("%q: expected response to echo %q, got %q", incoming, seen, echoed)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+// RequireScope only lets requests through that carry an API token with
+// the given scope as their bearer token.
+func RequireScope(apiTokens apitokens.APITokenStore, scope string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			token, ok := parseBearerToken(r)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			apiToken, err := apiTokens.Lookup(token)
+			if err != nil {
+				if !errors.Is(err, apitokens.ErrInvalidToken) {
+					logging.FromContext(r.Context()).Error("failed to look up api token", "error", err)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			logger := logging.FromContext(r.Context()).With("api_token", apiToken.Name)
+			if !apiToken.HasScope(scope) {
+				logger.Warn("api token lacks scope", "scope", scope)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			h(w, r.WithContext(logging.WithLogger(r.Context(), logger)), ps)
+		}
+	}
+}
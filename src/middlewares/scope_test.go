@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
+	"github.com/julienschmidt/httprouter"
+)
+
+type memoryAPITokens map[string]apitokens.APIToken
+
+func (m memoryAPITokens) Create(string, []string) (string, error) { return "", nil }
+
+func (m memoryAPITokens) Lookup(token string) (apitokens.APIToken, error) {
+	apiToken, ok := m[token]
+	if !ok {
+		return apitokens.APIToken{}, apitokens.ErrInvalidToken
+	}
+	return apiToken, nil
+}
+
+func (m memoryAPITokens) Revoke(string) error { return nil }
+
+func TestRequireScope(t *testing.T) {
+	tokens := memoryAPITokens{
+		"scraper": {Name: "grafana", Scopes: []string{apitokens.ScopeMetricsRead}},
+		"script":  {Name: "script"},
+	}
+	h := RequireScope(tokens, apitokens.ScopeMetricsRead)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := map[string]int{
+		"Bearer scraper": http.StatusOK,
+		"Bearer script":  http.StatusForbidden,
+		"Bearer unknown": http.StatusUnauthorized,
+		"Basic scraper":  http.StatusUnauthorized,
+		"":               http.StatusUnauthorized,
+	}
+	for authorization, want := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/metrics/events", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != want {
+			t.Errorf("%q: expected %d, got %d", authorization, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/erkannt/rechenschaftspflicht/services/logging"
+	"github.com/julienschmidt/httprouter"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceRoute names the request's server span after the matched route
+// pattern, which is only known once httprouter has dispatched. It also
+// replaces the path recorded by otelhttp with one that has feed tokens and
+// email addresses masked, as the logs do.
+func TraceRoute(route string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(
+				semconv.HTTPRoute(route),
+				semconv.URLPath(logging.Redact(r.URL.Path)),
+			)
+			h(w, r, ps)
+		}
+	}
+}
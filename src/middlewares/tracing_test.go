@@ -0,0 +1,51 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+func TestTraceRouteRedactsPath(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	const route = "/feed/:token/users/:user"
+	router := httprouter.New()
+	router.GET(route, TraceRoute(route)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}))
+	handler := otelhttp.NewHandler(router, "http.server", otelhttp.WithTracerProvider(provider))
+
+	const token = "secret-feed-token"
+	r := httptest.NewRequest(http.MethodGet, "/feed/"+token+"/users/jane@example.com", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET "+route {
+		t.Errorf("expected span to be named after the route, got %q", span.Name())
+	}
+
+	var path string
+	for _, attr := range span.Attributes() {
+		value := attr.Value.Emit()
+		if strings.Contains(value, token) || strings.Contains(value, "jane@") {
+			t.Errorf("attribute %s leaks the request path: %q", attr.Key, value)
+		}
+		if attr.Key == semconv.URLPathKey {
+			path = value
+		}
+	}
+	if path != "/feed/REDACTED/users/j***@example.com" {
+		t.Errorf("expected redacted url.path, got %q", path)
+	}
+}
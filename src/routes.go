@@ -1,13 +1,28 @@
 package main
 
 import (
+	"database/sql"
 	"embed"
+	"net/http"
+	"time"
 
 	"github.com/erkannt/rechenschaftspflicht/handlers"
 	"github.com/erkannt/rechenschaftspflicht/middlewares"
+	"github.com/erkannt/rechenschaftspflicht/services/admintokens"
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
 	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/clientip"
 	"github.com/erkannt/rechenschaftspflicht/services/config"
 	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/export"
+	"github.com/erkannt/rechenschaftspflicht/services/feedtokens"
+	"github.com/erkannt/rechenschaftspflicht/services/magiclinks"
+	"github.com/erkannt/rechenschaftspflicht/services/metrics"
+	"github.com/erkannt/rechenschaftspflicht/services/passkeys"
+	"github.com/erkannt/rechenschaftspflicht/services/ratelimit"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+	"github.com/erkannt/rechenschaftspflicht/services/sso"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
 	"github.com/erkannt/rechenschaftspflicht/services/userstore"
 	"github.com/julienschmidt/httprouter"
 )
@@ -15,27 +30,169 @@ import (
 //go:embed assets/* assets/**
 var embeddedAssets embed.FS
 
+// instrumentedRouter registers routes wrapped in request metrics, logs and
+// traces labelled by the route pattern.
+type instrumentedRouter struct {
+	*httprouter.Router
+	m *metrics.Metrics
+}
+
+func (ir instrumentedRouter) Handle(method, path string, h httprouter.Handle) {
+	h = middlewares.WithRoute(path)(middlewares.TraceRoute(path)(h))
+	ir.Router.Handle(method, path, middlewares.Instrument(ir.m, path)(h))
+}
+
+func (ir instrumentedRouter) GET(path string, h httprouter.Handle) {
+	ir.Handle(http.MethodGet, path, h)
+}
+
+func (ir instrumentedRouter) POST(path string, h httprouter.Handle) {
+	ir.Handle(http.MethodPost, path, h)
+}
+
+func (ir instrumentedRouter) PUT(path string, h httprouter.Handle) {
+	ir.Handle(http.MethodPut, path, h)
+}
+
+func (ir instrumentedRouter) DELETE(path string, h httprouter.Handle) {
+	ir.Handle(http.MethodDelete, path, h)
+}
+
+// addRoutes registers all routes and returns which of them take bearer
+// tokens instead of cookies.
 func addRoutes(
-	router *httprouter.Router,
+	router instrumentedRouter,
 	cfg config.Config,
+	db *sql.DB,
 	eventStore eventstore.EventStore,
 	userStore userstore.UserStore,
+	feedTokens feedtokens.FeedTokenStore,
+	magicLinks magiclinks.MagicLinkStore,
+	apiTokens apitokens.APITokenStore,
+	sessionStore sessions.SessionStore,
+	passkeyService *passkeys.Service,
+	ssoProvider *sso.Provider,
+	twoFactor *twofactor.Service,
 	auth authentication.Auth,
-) {
+	adminTokens *admintokens.Tokens,
+	clientIPs *clientip.Resolver,
+	limits ratelimit.Store,
+	m *metrics.Metrics,
+) (bearerRoutes func(*http.Request) bool) {
 	requireLogin := middlewares.MustBeLoggedIn(auth)
-	requireBearerToken := middlewares.RequireBearerToken(cfg.BearerToken)
+	requireBearerToken := middlewares.RequireBearerToken(adminTokens, ratelimit.New("admin_token_ip", limits, ratelimit.Policy{
+		Burst:     5,
+		Window:    time.Hour,
+		BaseDelay: 30 * time.Second,
+		MaxDelay:  time.Hour,
+	}), middlewares.ByClientIP(clientIPs))
+	// adminAPI registers routes authorized by admin tokens, and notes them
+	// as taking bearer tokens rather than cookies.
+	adminAPIRoutes := httprouter.New()
+	adminAPI := func(method, path string, h httprouter.Handle) {
+		router.Handle(method, path, requireBearerToken(h))
+		adminAPIRoutes.Handle(method, path, h)
+	}
+	requireMetricsScope := middlewares.RequireScope(apiTokens, apitokens.ScopeMetricsRead)
+	limitLoginsPerIP := loginLimit(cfg, limits, "login_ip", cfg.LoginLimitPerIP, middlewares.ByClientIP(clientIPs))
+	limitLoginsPerEmail := loginLimit(cfg, limits, "login_email", cfg.LoginLimitPerEmail, middlewares.ByFormValue("email"))
+	limitCodesPerIP := loginLimit(cfg, limits, "login_code_ip", cfg.LoginLimitPerIP, middlewares.ByClientIP(clientIPs))
+	limitPasskeysPerIP := loginLimit(cfg, limits, "passkey_ip", cfg.LoginLimitPerIP, middlewares.ByClientIP(clientIPs))
+	// Every passkey login begun stores a ceremony until it expires, so
+	// beginning them is limited on its own.
+	limitPasskeyCeremoniesPerIP := loginLimit(cfg, limits, "passkey_begin_ip", cfg.LoginLimitPerIP, middlewares.ByClientIP(clientIPs))
+	limitTOTPPerIP := loginLimit(cfg, limits, "totp_ip", cfg.LoginLimitPerIP, middlewares.ByClientIP(clientIPs))
+	limitTOTPPerUser := loginLimit(cfg, limits, "totp_user", 5, partialLoginEmail(auth))
+
+	ssoName := ""
+	if ssoProvider != nil {
+		ssoName = ssoProvider.Name()
+		router.GET("/login/oidc", limitLoginsPerIP(handlers.SSOLoginHandler(ssoProvider, cfg.AppOrigin)))
+		router.GET("/login/oidc/callback", handlers.SSOCallbackHandler(ssoProvider, userStore, auth, twoFactor, m))
+	}
 
-	router.GET("/", handlers.LandingHandler(auth))
-	router.POST("/login", handlers.LoginPostHandler(userStore, auth))
+	router.GET("/", handlers.LandingHandler(auth, ssoName))
+	router.POST("/login", limitLoginsPerIP(limitLoginsPerEmail(handlers.LoginPostHandler(userStore, magicLinks, auth, m, cfg.InvalidateOlderLinks, cfg.MaxOutstandingLinks))))
 	router.GET("/login", handlers.LoginGetHandler(auth))
+	router.POST("/login/link", handlers.LoginLinkHandler(magicLinks, auth, twoFactor, m))
+	router.POST("/login/code", limitCodesPerIP(handlers.LoginCodeHandler(magicLinks, auth, twoFactor, m)))
 	router.GET("/check-your-email", handlers.CheckYourEmailHandler)
+	router.GET("/login/totp", handlers.LoginTOTPHandler(twoFactor, auth))
+	router.POST("/login/totp", limitTOTPPerIP(limitTOTPPerUser(handlers.LoginTOTPPostHandler(twoFactor, auth, m))))
+	router.POST("/login/totp/enrol", limitTOTPPerIP(limitTOTPPerUser(handlers.LoginTOTPEnrolHandler(twoFactor, auth, m))))
+	router.GET("/login/totp/qr.png", handlers.LoginTOTPQRHandler(twoFactor, auth))
+	router.POST("/passkeys/login/begin", limitPasskeyCeremoniesPerIP(handlers.BeginPasskeyLoginHandler(passkeyService, cfg.AppOrigin)))
+	router.POST("/passkeys/login/finish", limitPasskeysPerIP(handlers.FinishPasskeyLoginHandler(passkeyService, userStore, auth, twoFactor, m)))
 	router.GET("/record-event", requireLogin(handlers.RecordEventFormHandler))
 	router.POST("/record-event", requireLogin(handlers.RecordEventPostHandler(eventStore, auth)))
-	router.GET("/all-events", requireLogin(handlers.AllEventsHandler(eventStore)))
+	router.GET("/all-events", requireLogin(handlers.AllEventsHandler(eventStore, cfg.AppOrigin)))
 	router.GET("/events.json", requireLogin(handlers.EventsJsonHandler(eventStore)))
+	router.GET("/events.csv", requireLogin(handlers.ExportEventsHandler(eventStore, export.CSV)))
+	router.GET("/events.ndjson", requireLogin(handlers.ExportEventsHandler(eventStore, export.NDJSON)))
+	router.GET("/events.xlsx", requireLogin(handlers.ExportEventsHandler(eventStore, export.XLSX)))
 	router.GET("/plots", requireLogin(handlers.PlotsHandler(eventStore)))
-	router.GET("/logout", requireLogin(handlers.LogoutHandler(auth)))
-	router.POST("/add-user", requireBearerToken(handlers.AddUserHandler(userStore)))
+	router.GET("/feeds", requireLogin(handlers.FeedsHandler(feedTokens, auth)))
+	router.POST("/feeds/token", requireLogin(handlers.CreateFeedTokenHandler(feedTokens, auth, cfg.AppOrigin)))
+	router.POST("/feeds/token/revoke", requireLogin(handlers.RevokeFeedTokenHandler(feedTokens, auth)))
+	router.GET("/feed/:token/all", handlers.AtomFeedHandler(eventStore, feedTokens, userStore, cfg.AppOrigin))
+	router.GET("/feed/:token/users/:user", handlers.AtomFeedHandler(eventStore, feedTokens, userStore, cfg.AppOrigin))
+	router.GET("/feed/:token/tags/:tag", handlers.AtomFeedHandler(eventStore, feedTokens, userStore, cfg.AppOrigin))
+	router.GET("/feed/:token/events.ics", handlers.ICalFeedHandler(eventStore, feedTokens, userStore, cfg.AppOrigin))
+	router.GET("/sessions", requireLogin(handlers.SessionsHandler(sessionStore, auth)))
+	router.POST("/sessions/revoke", requireLogin(handlers.RevokeSessionHandler(sessionStore, auth)))
+	router.POST("/sessions/revoke-all", requireLogin(handlers.RevokeAllSessionsHandler(sessionStore, auth)))
+	router.GET("/passkeys", requireLogin(handlers.PasskeysHandler(passkeyService, auth)))
+	router.POST("/passkeys/register/begin", requireLogin(handlers.BeginPasskeyRegistrationHandler(passkeyService, auth, cfg.AppOrigin)))
+	router.POST("/passkeys/register/finish", requireLogin(handlers.FinishPasskeyRegistrationHandler(passkeyService, auth)))
+	router.POST("/passkeys/remove", requireLogin(handlers.RemovePasskeyHandler(passkeyService, auth)))
+	router.GET("/two-factor", requireLogin(handlers.TwoFactorHandler(twoFactor, auth)))
+	router.POST("/two-factor/enrol", requireLogin(handlers.TwoFactorEnrolHandler(twoFactor, auth)))
+	router.POST("/two-factor/confirm", requireLogin(handlers.TwoFactorConfirmHandler(twoFactor, auth)))
+	router.GET("/two-factor/qr.png", requireLogin(handlers.TwoFactorQRHandler(twoFactor, auth)))
+	router.POST("/two-factor/disable", requireLogin(handlers.TwoFactorDisableHandler(twoFactor, auth)))
+	router.POST("/logout", requireLogin(handlers.LogoutHandler(auth)))
+	adminAPI(http.MethodPost, "/add-user", handlers.AddUserHandler(userStore))
+	adminAPI(http.MethodPut, "/users/:email/roles", handlers.SetRolesHandler(userStore))
+	adminAPI(http.MethodPost, "/api-tokens", handlers.CreateAPITokenHandler(apiTokens))
+	adminAPI(http.MethodDelete, "/api-tokens/:name", handlers.RevokeAPITokenHandler(apiTokens))
+
+	router.GET("/metrics", requireMetricsScope(handlers.OperationalMetricsHandler(m)))
+	router.GET("/metrics/events", requireMetricsScope(handlers.EventMetricsHandler(eventStore)))
+	router.GET("/healthz", handlers.HealthzHandler)
+	router.GET("/readyz", handlers.ReadyzHandler(db, auth))
 
 	router.GET("/assets/*filepath", handlers.AssetsHandler(embeddedAssets))
+
+	return func(r *http.Request) bool {
+		h, _, _ := adminAPIRoutes.Lookup(r.Method, r.URL.Path)
+		return h != nil
+	}
+}
+
+// loginLimit allows burst login attempts per key, then backs off
+// exponentially from 30 seconds up to the limit window. A burst of zero
+// disables the limit.
+func loginLimit(cfg config.Config, store ratelimit.Store, name string, burst int, key func(*http.Request) string) func(httprouter.Handle) httprouter.Handle {
+	if burst == 0 {
+		return func(h httprouter.Handle) httprouter.Handle { return h }
+	}
+	limiter := ratelimit.New(name, store, ratelimit.Policy{
+		Burst:     burst,
+		Window:    cfg.LoginLimitWindow,
+		BaseDelay: 30 * time.Second,
+		MaxDelay:  cfg.LoginLimitWindow,
+	})
+	return middlewares.RateLimit(limiter, key)
+}
+
+// partialLoginEmail keys requests by the user who is partially logged in,
+// so guessing second factor codes is limited across addresses too.
+func partialLoginEmail(auth authentication.Auth) func(*http.Request) string {
+	return func(r *http.Request) string {
+		claims, err := auth.PartialLogin(r)
+		if err != nil {
+			return ""
+		}
+		return claims.Email
+	}
 }
@@ -0,0 +1,127 @@
+// Package admintokens holds the bearer tokens that authorize the admin API.
+// Several named tokens can be valid at once, so a new token can be handed
+// out before the old one is removed. Tokens may be configured by their
+// SHA-256 hash to keep the token itself out of the environment.
+package admintokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LegacyName is the name of the token given as BEARER_TOKEN.
+const LegacyName = "default"
+
+// hashPrefix marks a token given by its hash rather than in plain text.
+const hashPrefix = "sha256:"
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type token struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+type Tokens struct {
+	tokens []token
+}
+
+// New builds the set of tokens from "name:token" or "name:sha256:<hex>"
+// entries and, if set, the legacy single token, which is always taken as
+// plain text.
+func New(entries []string, legacy string) (*Tokens, error) {
+	t := &Tokens{}
+	add := func(name string, hash [sha256.Size]byte) error {
+		for _, existing := range t.tokens {
+			if existing.name == name {
+				return fmt.Errorf("admin token name %q is used twice", name)
+			}
+		}
+		t.tokens = append(t.tokens, token{name: name, hash: hash})
+		return nil
+	}
+
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok || value == "" {
+			return nil, errors.New("admin token must be given as name:token or name:sha256:<hex>")
+		}
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("admin token name %q may only contain letters, digits, '.', '_' and '-'", name)
+		}
+		hash, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("admin token %q: %w", name, err)
+		}
+		if err := add(name, hash); err != nil {
+			return nil, err
+		}
+	}
+	if legacy != "" {
+		if err := add(LegacyName, sha256.Sum256([]byte(legacy))); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.tokens) == 0 {
+		return nil, errors.New("no admin tokens configured")
+	}
+	return t, nil
+}
+
+func parseValue(value string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	hexHash, hashed := strings.CutPrefix(value, hashPrefix)
+	if !hashed {
+		return sha256.Sum256([]byte(value)), nil
+	}
+	b, err := hex.DecodeString(hexHash)
+	if err != nil || len(b) != sha256.Size {
+		return hash, errors.New("hash must be 64 hex digits")
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// Match returns the name of the token presented, if it is one of the
+// configured tokens. It takes the same time whichever token, if any,
+// matches.
+func (t *Tokens) Match(presented string) (string, bool) {
+	hash := sha256.Sum256([]byte(presented))
+	name, found := "", false
+	for _, tok := range t.tokens {
+		if subtle.ConstantTimeCompare(hash[:], tok.hash[:]) == 1 {
+			name, found = tok.name, true
+		}
+	}
+	return name, found
+}
+
+// Names returns the names of the tokens in the order they were configured.
+func (t *Tokens) Names() []string {
+	names := make([]string, len(t.tokens))
+	for i, tok := range t.tokens {
+		names[i] = tok.name
+	}
+	return names
+}
+
+// Hash returns token in the form for configuring it by its hash.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Generate returns a new random token.
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
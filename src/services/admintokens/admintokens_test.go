@@ -0,0 +1,75 @@
+package admintokens
+
+import (
+	"testing"
+)
+
+func TestMatchPlainAndHashedTokens(t *testing.T) {
+	tokens, err := New([]string{"ci:plain-token", "ops:" + Hash("hashed-token")}, "legacy-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := map[string]string{
+		"plain-token":  "ci",
+		"hashed-token": "ops",
+		"legacy-token": LegacyName,
+	}
+	for presented, want := range cases {
+		if name, ok := tokens.Match(presented); !ok || name != want {
+			t.Errorf("expected %q to match %q, got %q, %v", presented, want, name, ok)
+		}
+	}
+
+	for _, presented := range []string{"", "wrong", Hash("hashed-token"), "plain-token "} {
+		if name, ok := tokens.Match(presented); ok {
+			t.Errorf("expected %q not to match, matched %q", presented, name)
+		}
+	}
+}
+
+func TestLegacyTokenIsPlainText(t *testing.T) {
+	legacy := Hash("secret")
+	tokens, err := New(nil, legacy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := tokens.Match(legacy); !ok {
+		t.Error("expected legacy token to match as given")
+	}
+	if _, ok := tokens.Match("secret"); ok {
+		t.Error("expected legacy token not to be taken as a hash")
+	}
+}
+
+func TestNewRejectsBadTokens(t *testing.T) {
+	cases := map[string][]string{
+		"empty":          nil,
+		"missing token":  {"a:"},
+		"no separator":   {"token"},
+		"bad name":       {"a b:token"},
+		"duplicate name": {"a:t1", "a:t2"},
+		"short hash":     {"a:sha256:abcd"},
+		"non-hex hash":   {"a:sha256:" + string(make([]byte, 64))},
+	}
+	for name, entries := range cases {
+		if _, err := New(entries, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := New([]string{LegacyName + ":token"}, "legacy"); err == nil {
+		t.Error("expected an error for a name clashing with the legacy token")
+	}
+}
+
+func TestGeneratedTokensDiffer(t *testing.T) {
+	a, err := Generate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := Generate()
+	if a == b || len(a) != 64 {
+		t.Errorf("expected two distinct 64 character tokens, got %q and %q", a, b)
+	}
+}
@@ -0,0 +1,103 @@
+package apitokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes grant API tokens access to specific machine-facing endpoints.
+const (
+	ScopeMetricsRead = "metrics:read"
+)
+
+var KnownScopes = []string{ScopeMetricsRead}
+
+var ErrInvalidToken = errors.New("invalid api token")
+
+type APIToken struct {
+	Name      string
+	Scopes    []string
+	CreatedAt string
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// APITokenStore manages named tokens for scripts and scrapers. Only a hash
+// of each token is stored.
+type APITokenStore interface {
+	Create(name string, scopes []string) (string, error)
+	Lookup(token string) (APIToken, error)
+	Revoke(name string) error
+}
+
+type SQLiteAPITokenStore struct {
+	db *sql.DB
+}
+
+func NewAPITokenStore(db *sql.DB) APITokenStore {
+	return &SQLiteAPITokenStore{db: db}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SQLiteAPITokenStore) Create(name string, scopes []string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	const query = `
+		INSERT INTO api_tokens (name, tokenHash, scopes, createdAt)
+		VALUES (?, ?, ?, ?);
+	`
+
+	_, err := s.db.Exec(query, name, hashToken(token), strings.Join(scopes, " "), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *SQLiteAPITokenStore) Lookup(token string) (APIToken, error) {
+	const query = `
+		SELECT name, scopes, createdAt
+		FROM api_tokens
+		WHERE tokenHash = ? AND revokedAt IS NULL;
+	`
+
+	var t APIToken
+	var scopes string
+	err := s.db.QueryRow(query, hashToken(token)).Scan(&t.Name, &scopes, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIToken{}, ErrInvalidToken
+	}
+	if err != nil {
+		return APIToken{}, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	return t, nil
+}
+
+func (s *SQLiteAPITokenStore) Revoke(name string) error {
+	const query = `
+		UPDATE api_tokens
+		SET revokedAt = ?
+		WHERE name = ? AND revokedAt IS NULL;
+	`
+
+	_, err := s.db.Exec(query, time.Now().Format(time.RFC3339), name)
+	return err
+}
@@ -0,0 +1,58 @@
+package apitokens
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+)
+
+func newTestStore(t *testing.T) APITokenStore {
+	t.Helper()
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return NewAPITokenStore(db)
+}
+
+func TestCreateLookupRevoke(t *testing.T) {
+	s := newTestStore(t)
+
+	token, err := s.Create("grafana", []string{ScopeMetricsRead})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other, err := s.Create("script", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	apiToken, err := s.Lookup(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if apiToken.Name != "grafana" || !slices.Equal(apiToken.Scopes, []string{ScopeMetricsRead}) || !apiToken.HasScope(ScopeMetricsRead) {
+		t.Errorf("unexpected token %+v", apiToken)
+	}
+	if apiToken, err := s.Lookup(other); err != nil || apiToken.HasScope(ScopeMetricsRead) {
+		t.Errorf("expected a token without scopes, got %+v, %v", apiToken, err)
+	}
+	if _, err := s.Lookup("not-a-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	if err := s.Revoke("grafana"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Lookup(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v for a revoked token, got %v", ErrInvalidToken, err)
+	}
+	if _, err := s.Lookup(other); err != nil {
+		t.Errorf("expected other tokens to keep working, got %v", err)
+	}
+}
@@ -1,35 +1,117 @@
 package authentication
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/smtp"
 	"time"
 
 	"github.com/erkannt/rechenschaftspflicht/services/config"
+	"github.com/erkannt/rechenschaftspflicht/services/keyring"
+	"github.com/erkannt/rechenschaftspflicht/services/requestid"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 // Auth defines the public contract for the service.
 type Auth interface {
-	GenerateToken(email string) (string, error)
-	ValidateToken(tokenStr string) (string, error)
-	SendMagicLink(toEmail, token string) error
+	// GenerateToken returns a token for a magic link along with its
+	// claims. remember asks for the session started with it to outlive the
+	// browser session.
+	GenerateToken(email string, remember bool) (string, Claims, error)
+	// ValidateMagicLink accepts only tokens from GenerateToken, never
+	// session tokens.
+	ValidateMagicLink(tokenStr string) (Claims, error)
+	// SendMagicLink emails the link for token along with code, which can
+	// be entered instead in the browser that asked for the link.
+	SendMagicLink(ctx context.Context, toEmail, token, code string) error
+	PingMailer(ctx context.Context) error
+	// BindLoginCode returns a cookie that lets this browser, and only this
+	// one, log in with the code sent along with the link in claims.
+	BindLoginCode(claims Claims) http.Cookie
+	// DecoyLoginCode returns a cookie that looks like BindLoginCode's but
+	// is bound to no link, for login requests that sent none.
+	DecoyLoginCode() (http.Cookie, error)
+	// BoundLoginCode returns the ID of the link whose code this browser
+	// may enter.
+	BoundLoginCode(r *http.Request) (string, error)
+	// IsLoggedIn and GetLoggedInUserEmail accept only sessions that have
+	// not been revoked.
 	IsLoggedIn(r *http.Request) bool
 	GetLoggedInUserEmail(r *http.Request) (string, error)
-	LoggedIn(token string) http.Cookie
-	LoggedOut() http.Cookie
+	// CurrentSession returns the claims of the request's session, whose ID
+	// is the session's ID in the session store.
+	CurrentSession(r *http.Request) (Claims, error)
+	// LoggedIn starts a new session for validated claims, recording the
+	// device it was started from, and returns its cookie.
+	LoggedIn(r *http.Request, claims Claims) (http.Cookie, error)
+	// RefreshSession returns the email of the request's session, and a
+	// renewed session cookie once half of the session's lifetime has
+	// passed, so active users stay logged in. The cookie is nil if no
+	// renewal is due. The email is empty if there is no valid session, and
+	// is returned with the error if only the renewal failed.
+	RefreshSession(r *http.Request) (string, *http.Cookie, error)
+	// LoggedOut revokes the request's session, if any, and returns a cookie
+	// clearing it.
+	LoggedOut(r *http.Request) (http.Cookie, error)
+	// PartiallyLoggedIn returns a short-lived cookie recording that the
+	// user of validated claims passed the first factor and still owes a
+	// second one. It grants nothing a logged out user couldn't do.
+	PartiallyLoggedIn(claims Claims) (http.Cookie, error)
+	// PartialLogin returns the claims of the request's partial login.
+	PartialLogin(r *http.Request) (Claims, error)
+	// ClearPartialLogin returns a cookie ending the partial login.
+	ClearPartialLogin() http.Cookie
+}
+
+// ErrSessionRevoked is returned for sessions that have been logged out or
+// revoked, even though their token is still valid.
+var ErrSessionRevoked = errors.New("session revoked")
+
+// lastSeenInterval limits how often a session's last activity is written.
+const lastSeenInterval = time.Minute
+
+// Magic link, session and partial login tokens are signed with the same
+// key, so the typ claim keeps one from being accepted as another: a link
+// that sat in an inbox must not work as a session cookie, and vice versa.
+const (
+	tokenTypeMagicLink    = "magic_link"
+	tokenTypeSession      = "session"
+	tokenTypePartialLogin = "partial_login"
+)
+
+// partialLoginTTL is how long users have to enter their second factor.
+const partialLoginTTL = 10 * time.Minute
+
+// Claims are the contents of a valid token.
+type Claims struct {
+	// ID is unique per token (the jti claim).
+	ID        string
+	Email     string
+	Remember  bool
+	ExpiresAt time.Time
 }
 
 // magicLinksSvc is the concrete implementation holding internal state.
 type magicLinksSvc struct {
-	jwtSecret []byte
+	keys      *keyring.Keyring
 	smtpAuth  smtp.Auth
 	smtpFrom  string
 	smtpAddr  string
 	appOrigin string
 	isHTTPS   bool
+
+	magicLinkTTL      time.Duration
+	sessionTTL        time.Duration
+	rememberDeviceTTL time.Duration
+
+	sessions sessions.SessionStore
 }
 
 func createSmtpAuth(logger *slog.Logger, cfg config.Config) smtp.Auth {
@@ -41,14 +123,18 @@ func createSmtpAuth(logger *slog.Logger, cfg config.Config) smtp.Auth {
 	return smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPass, cfg.SMTPHost)
 }
 
-func New(logger *slog.Logger, cfg config.Config) Auth {
+func New(logger *slog.Logger, cfg config.Config, keys *keyring.Keyring, sessionStore sessions.SessionStore) Auth {
 	return &magicLinksSvc{
-		jwtSecret: []byte(cfg.JWTSecret),
-		smtpAuth:  createSmtpAuth(logger, cfg),
-		smtpFrom:  cfg.SMTPFrom,
-		smtpAddr:  fmt.Sprintf("%s:%s", cfg.SMTPHost, cfg.SMTPPort),
-		appOrigin: cfg.AppOrigin,
-		isHTTPS:   isHTTPS(cfg.AppOrigin),
+		keys:              keys,
+		smtpAuth:          createSmtpAuth(logger, cfg),
+		smtpFrom:          cfg.SMTPFrom,
+		smtpAddr:          fmt.Sprintf("%s:%s", cfg.SMTPHost, cfg.SMTPPort),
+		appOrigin:         cfg.AppOrigin,
+		isHTTPS:           isHTTPS(cfg.AppOrigin),
+		magicLinkTTL:      cfg.MagicLinkTTL,
+		sessionTTL:        cfg.SessionTTL,
+		rememberDeviceTTL: cfg.RememberDeviceTTL,
+		sessions:          sessionStore,
 	}
 }
 
@@ -57,89 +143,340 @@ func isHTTPS(origin string) bool {
 	return len(origin) > 5 && origin[:5] == "https"
 }
 
-func (s *magicLinksSvc) GenerateToken(email string) (string, error) {
-	claims := jwt.MapClaims{
-		"email": email,
-		"exp":   time.Now().Add(15 * time.Minute).Unix(),
+func (s *magicLinksSvc) GenerateToken(email string, remember bool) (string, Claims, error) {
+	id, err := newID()
+	if err != nil {
+		return "", Claims{}, err
+	}
+	return s.sign(tokenTypeMagicLink, id, email, remember, s.magicLinkTTL)
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (s *magicLinksSvc) sign(typ, id, email string, remember bool, ttl time.Duration) (string, Claims, error) {
+	now := time.Now()
+	claims := Claims{
+		ID:        id,
+		Email:     email,
+		Remember:  remember,
+		ExpiresAt: now.Add(ttl).Truncate(time.Second),
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":      typ,
+		"jti":      claims.ID,
+		"email":    claims.Email,
+		"remember": claims.Remember,
+		"iat":      now.Unix(),
+		"exp":      claims.ExpiresAt.Unix(),
+	})
+	key := s.keys.Active()
+	t.Header["kid"] = key.ID
+	token, err := t.SignedString(key.Secret)
+	if err != nil {
+		return "", Claims{}, err
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(s.jwtSecret)
+	return token, claims, nil
+}
+
+func (s *magicLinksSvc) ValidateMagicLink(input string) (Claims, error) {
+	return s.validate(input, tokenTypeMagicLink)
 }
 
-// ValidateToken parses and validates the JWT, returning the embedded email if valid.
-func (s *magicLinksSvc) ValidateToken(input string) (string, error) {
+// validate parses and validates the JWT, returning its claims if valid and
+// of the expected type.
+func (s *magicLinksSvc) validate(input, typ string) (Claims, error) {
 	token, err := jwt.Parse(input, func(t *jwt.Token) (any, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method")
 		}
-		return s.jwtSecret, nil
+		// Tokens from before key IDs were introduced have no kid.
+		kid, _ := t.Header["kid"].(string)
+		key, ok := s.keys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key.Secret, nil
 	})
 	if err != nil || !token.Valid {
-		return "", fmt.Errorf("invalid token")
+		return Claims{}, fmt.Errorf("invalid token")
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		if email, ok := claims["email"].(string); ok {
-			return email, nil
-		}
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Claims{}, fmt.Errorf("invalid token")
+	}
+	if t, _ := mapClaims["typ"].(string); t != typ {
+		return Claims{}, fmt.Errorf("not a %s token", typ)
+	}
+	email, ok := mapClaims["email"].(string)
+	if !ok {
+		return Claims{}, fmt.Errorf("email claim missing")
+	}
+	claims := Claims{Email: email}
+	claims.ID, _ = mapClaims["jti"].(string)
+	claims.Remember, _ = mapClaims["remember"].(bool)
+	if exp, ok := mapClaims["exp"].(float64); ok {
+		claims.ExpiresAt = time.Unix(int64(exp), 0)
 	}
-	return "", fmt.Errorf("email claim missing")
+	return claims, nil
 }
 
-// SendMagicLink sends an email containing a login link with the supplied token.
-func (s *magicLinksSvc) SendMagicLink(toEmail, token string) error {
+// SendMagicLink sends an email containing a login link with the supplied
+// token and the code to enter instead. The request ID from ctx is set as a
+// header on the email and carried in the link, so the later login can be
+// traced back to the request that sent it.
+func (s *magicLinksSvc) SendMagicLink(ctx context.Context, toEmail, token, code string) error {
 	if s.smtpFrom == "" {
 		return fmt.Errorf("SMTP configuration incomplete: missing from address")
 	}
 
 	link := fmt.Sprintf("%s/login?token=%s", s.appOrigin, token)
+	headers := fmt.Sprintf("From: %s\r\nSubject: Your Magic Login Link\r\n", s.smtpFrom)
+	if id := requestid.FromContext(ctx); id != "" {
+		link += "&rid=" + id
+		headers += fmt.Sprintf("%s: %s\r\n", requestid.Header, id)
+	}
 	msg := fmt.Sprintf(
-		"From: %s\r\nSubject: Your Magic Login Link\r\n\r\nClick the following link to log in:\n\n%s",
-		s.smtpFrom,
-		link,
+		"%s\r\nClick the following link to log in:\n\n%s\n\nOr enter this code in the browser where you asked for the link:\n\n%s",
+		headers, link, code,
 	)
 
 	return smtp.SendMail(s.smtpAddr, s.smtpAuth, s.smtpFrom, []string{toEmail}, []byte(msg))
 }
 
-func (s *magicLinksSvc) IsLoggedIn(r *http.Request) bool {
-	cookie, err := r.Cookie("auth")
-	if err != nil || cookie.Value == "" {
-		return false
+// PingMailer checks that the SMTP server accepts connections and greets.
+func (s *magicLinksSvc) PingMailer(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.smtpAddr)
+	if err != nil {
+		return err
 	}
-	if email, err := s.ValidateToken(cookie.Value); err != nil || email == "" {
-		return false
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
 	}
-	return true
+
+	host, _, _ := net.SplitHostPort(s.smtpAddr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return client.Quit()
 }
 
-func (s *magicLinksSvc) GetLoggedInUserEmail(r *http.Request) (string, error) {
-	cookie, err := r.Cookie("auth")
+const loginCodeCookie = "login_code"
+
+const partialLoginCookie = "auth_partial"
+
+func (s *magicLinksSvc) PartiallyLoggedIn(claims Claims) (http.Cookie, error) {
+	id, err := newID()
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	token, partial, err := s.sign(tokenTypePartialLogin, id, claims.Email, claims.Remember, partialLoginTTL)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return http.Cookie{
+		Name:     partialLoginCookie,
+		Value:    token,
+		Path:     "/login/totp",
+		Expires:  partial.ExpiresAt,
+		HttpOnly: true,
+		Secure:   s.isHTTPS,
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+func (s *magicLinksSvc) PartialLogin(r *http.Request) (Claims, error) {
+	cookie, err := r.Cookie(partialLoginCookie)
+	if err != nil {
+		return Claims{}, err
+	}
+	return s.validate(cookie.Value, tokenTypePartialLogin)
+}
+
+func (s *magicLinksSvc) ClearPartialLogin() http.Cookie {
+	return http.Cookie{
+		Name:     partialLoginCookie,
+		Value:    "",
+		Path:     "/login/totp",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.isHTTPS,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (s *magicLinksSvc) BindLoginCode(claims Claims) http.Cookie {
+	return http.Cookie{
+		Name:     loginCodeCookie,
+		Value:    claims.ID,
+		Path:     "/login/code",
+		Expires:  claims.ExpiresAt,
+		HttpOnly: true,
+		Secure:   s.isHTTPS,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (s *magicLinksSvc) DecoyLoginCode() (http.Cookie, error) {
+	id, err := newID()
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return s.BindLoginCode(Claims{
+		ID:        id,
+		ExpiresAt: time.Now().Add(s.magicLinkTTL).Truncate(time.Second),
+	}), nil
+}
+
+func (s *magicLinksSvc) BoundLoginCode(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(loginCodeCookie)
 	if err != nil {
 		return "", err
 	}
 	if cookie.Value == "" {
 		return "", http.ErrNoCookie
 	}
-	email, err := s.ValidateToken(cookie.Value)
+	return cookie.Value, nil
+}
+
+func (s *magicLinksSvc) IsLoggedIn(r *http.Request) bool {
+	email, err := s.GetLoggedInUserEmail(r)
+	return err == nil && email != ""
+}
+
+func (s *magicLinksSvc) session(r *http.Request) (Claims, error) {
+	cookie, err := r.Cookie("auth")
+	if err != nil {
+		return Claims{}, err
+	}
+	if cookie.Value == "" {
+		return Claims{}, http.ErrNoCookie
+	}
+	claims, err := s.validate(cookie.Value, tokenTypeSession)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	stored, err := s.sessions.Get(r.Context(), claims.ID)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return Claims{}, ErrSessionRevoked
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+	if lastSeen, err := time.Parse(time.RFC3339, stored.LastSeenAt); err != nil || time.Since(lastSeen) > lastSeenInterval {
+		if err := s.sessions.Touch(r.Context(), claims.ID, time.Now(), claims.ExpiresAt); err != nil {
+			return Claims{}, err
+		}
+	}
+	return claims, nil
+}
+
+func (s *magicLinksSvc) CurrentSession(r *http.Request) (Claims, error) {
+	return s.session(r)
+}
+
+func (s *magicLinksSvc) GetLoggedInUserEmail(r *http.Request) (string, error) {
+	claims, err := s.session(r)
 	if err != nil {
 		return "", err
 	}
-	return email, nil
+	return claims.Email, nil
 }
 
-func (s *magicLinksSvc) LoggedIn(token string) http.Cookie {
-	return http.Cookie{
+func (s *magicLinksSvc) sessionLifetime(remember bool) time.Duration {
+	if remember {
+		return s.rememberDeviceTTL
+	}
+	return s.sessionTTL
+}
+
+func (s *magicLinksSvc) LoggedIn(r *http.Request, claims Claims) (http.Cookie, error) {
+	id, err := newID()
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	token, session, err := s.sign(tokenTypeSession, id, claims.Email, claims.Remember, s.sessionLifetime(claims.Remember))
+	if err != nil {
+		return http.Cookie{}, err
+	}
+
+	now := sessions.Timestamp(time.Now())
+	err = s.sessions.Create(r.Context(), sessions.Session{
+		ID:         session.ID,
+		Email:      session.Email,
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  sessions.Timestamp(session.ExpiresAt),
+	})
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return s.sessionCookie(token, session), nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *magicLinksSvc) sessionCookie(token string, claims Claims) http.Cookie {
+	cookie := http.Cookie{
 		Name:     "auth",
 		Value:    token,
 		Path:     "/",
-		Expires:  time.Now().Add(15 * time.Minute),
 		HttpOnly: true,
 		Secure:   s.isHTTPS,
 		SameSite: http.SameSiteLaxMode,
 	}
+	// Without remember the cookie ends with the browser session, and the
+	// token expires after sessionTTL of inactivity.
+	if claims.Remember {
+		cookie.Expires = claims.ExpiresAt
+	}
+	return cookie
 }
 
-func (s *magicLinksSvc) LoggedOut() http.Cookie {
+func (s *magicLinksSvc) RefreshSession(r *http.Request) (string, *http.Cookie, error) {
+	claims, err := s.session(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if time.Until(claims.ExpiresAt) > s.sessionLifetime(claims.Remember)/2 {
+		return claims.Email, nil, nil
+	}
+	// The renewed token keeps the session's ID, so it stays revocable.
+	token, renewed, err := s.sign(tokenTypeSession, claims.ID, claims.Email, claims.Remember, s.sessionLifetime(claims.Remember))
+	if err != nil {
+		return claims.Email, nil, err
+	}
+	if err := s.sessions.Touch(r.Context(), renewed.ID, time.Now(), renewed.ExpiresAt); err != nil {
+		return claims.Email, nil, err
+	}
+	cookie := s.sessionCookie(token, renewed)
+	return claims.Email, &cookie, nil
+}
+
+func (s *magicLinksSvc) LoggedOut(r *http.Request) (http.Cookie, error) {
+	if claims, err := s.session(r); err == nil {
+		if err := s.sessions.Revoke(r.Context(), claims.Email, claims.ID); err != nil {
+			return http.Cookie{}, err
+		}
+	}
 	return http.Cookie{
 		Name:     "auth",
 		Value:    "",
@@ -149,5 +486,5 @@ func (s *magicLinksSvc) LoggedOut() http.Cookie {
 		HttpOnly: true,
 		Secure:   s.isHTTPS,
 		SameSite: http.SameSiteLaxMode,
-	}
+	}, nil
 }
@@ -0,0 +1,262 @@
+package authentication
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	"github.com/erkannt/rechenschaftspflicht/services/keyring"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+)
+
+// memorySessions is a SessionStore that ignores expiry.
+type memorySessions map[string]sessions.Session
+
+func (m memorySessions) Create(_ context.Context, session sessions.Session) error {
+	m[session.ID] = session
+	return nil
+}
+
+func (m memorySessions) Get(_ context.Context, id string) (sessions.Session, error) {
+	session, ok := m[id]
+	if !ok {
+		return sessions.Session{}, sessions.ErrNotFound
+	}
+	return session, nil
+}
+
+func (m memorySessions) Touch(_ context.Context, id string, lastSeenAt, _ time.Time) error {
+	if session, ok := m[id]; ok {
+		session.LastSeenAt = sessions.Timestamp(lastSeenAt)
+		m[id] = session
+	}
+	return nil
+}
+
+func (m memorySessions) Active(_ context.Context, email string) ([]sessions.Session, error) {
+	var active []sessions.Session
+	for _, session := range m {
+		if session.Email == email {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+func (m memorySessions) Revoke(_ context.Context, email, id string) error {
+	if m[id].Email == email {
+		delete(m, id)
+	}
+	return nil
+}
+
+func (m memorySessions) RevokeAll(_ context.Context, email string) error {
+	for id, session := range m {
+		if session.Email == email {
+			delete(m, id)
+		}
+	}
+	return nil
+}
+
+func newTestAuthWithKeys(t *testing.T, entries []string, active string) Auth {
+	t.Helper()
+	keys, err := keyring.New(entries, active, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{
+		AppOrigin:         "http://localhost:8080",
+		MagicLinkTTL:      15 * time.Minute,
+		SessionTTL:        time.Hour,
+		RememberDeviceTTL: 24 * time.Hour,
+	}, keys, memorySessions{})
+}
+
+func newTestAuth(t *testing.T) Auth {
+	t.Helper()
+	return newTestAuthWithKeys(t, []string{"test:test-secret"}, "")
+}
+
+func requestWithCookie(value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "auth", Value: value})
+	return r
+}
+
+func TestMagicLinkIsNotASession(t *testing.T) {
+	auth := newTestAuth(t)
+
+	token, _, err := auth.GenerateToken("user@example.com", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := auth.ValidateMagicLink(token); err != nil {
+		t.Fatalf("expected magic link to validate: %v", err)
+	}
+	if auth.IsLoggedIn(requestWithCookie(token)) {
+		t.Error("magic link token accepted as session cookie")
+	}
+}
+
+func TestSessionIsNotAMagicLink(t *testing.T) {
+	auth := newTestAuth(t)
+
+	token, _, err := auth.GenerateToken("user@example.com", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	claims, err := auth.ValidateMagicLink(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cookie, err := auth.LoggedIn(httptest.NewRequest(http.MethodGet, "/", nil), claims)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cookie.Value == token {
+		t.Error("session reuses the magic link token")
+	}
+	if email, err := auth.GetLoggedInUserEmail(requestWithCookie(cookie.Value)); err != nil || email != "user@example.com" {
+		t.Errorf("expected session for user@example.com, got %q, %v", email, err)
+	}
+	if _, err := auth.ValidateMagicLink(cookie.Value); err == nil {
+		t.Error("session token accepted as magic link")
+	}
+}
+
+func TestPartialLoginIsNotASession(t *testing.T) {
+	auth := newTestAuth(t)
+
+	partial, err := auth.PartiallyLoggedIn(Claims{Email: "user@example.com", Remember: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/login/totp", nil)
+	r.AddCookie(&partial)
+	claims, err := auth.PartialLogin(r)
+	if err != nil || claims.Email != "user@example.com" || !claims.Remember {
+		t.Errorf("expected partial login of user@example.com, got %+v, %v", claims, err)
+	}
+
+	if auth.IsLoggedIn(requestWithCookie(partial.Value)) {
+		t.Error("partial login accepted as session cookie")
+	}
+	if _, err := auth.ValidateMagicLink(partial.Value); err == nil {
+		t.Error("partial login accepted as magic link")
+	}
+}
+
+func TestRememberedSessionCookiePersists(t *testing.T) {
+	auth := newTestAuth(t)
+
+	cookie, err := auth.LoggedIn(httptest.NewRequest(http.MethodGet, "/", nil), Claims{Email: "user@example.com", Remember: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Until(cookie.Expires) < 23*time.Hour {
+		t.Errorf("expected cookie to last about a day, expires %v", cookie.Expires)
+	}
+
+	cookie, err = auth.LoggedIn(httptest.NewRequest(http.MethodGet, "/", nil), Claims{Email: "user@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cookie.Expires.IsZero() {
+		t.Errorf("expected browser session cookie, expires %v", cookie.Expires)
+	}
+}
+
+func TestLoggedOutSessionIsRejected(t *testing.T) {
+	auth := newTestAuth(t)
+
+	cookie, err := auth.LoggedIn(httptest.NewRequest(http.MethodGet, "/", nil), Claims{Email: "user@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !auth.IsLoggedIn(requestWithCookie(cookie.Value)) {
+		t.Fatal("expected new session to be logged in")
+	}
+
+	if _, err := auth.LoggedOut(requestWithCookie(cookie.Value)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if auth.IsLoggedIn(requestWithCookie(cookie.Value)) {
+		t.Error("session still accepted after logging out")
+	}
+}
+
+func TestRotatedKeysStillVerify(t *testing.T) {
+	before := newTestAuthWithKeys(t, []string{"old:old-secret"}, "")
+	token, _, err := before.GenerateToken("user@example.com", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	after := newTestAuthWithKeys(t, []string{"new:new-secret", "old:old-secret"}, "")
+	if _, err := after.ValidateMagicLink(token); err != nil {
+		t.Errorf("expected token signed with the previous key to verify: %v", err)
+	}
+
+	retired := newTestAuthWithKeys(t, []string{"new:new-secret"}, "")
+	if _, err := retired.ValidateMagicLink(token); err == nil {
+		t.Error("expected token signed with a retired key to be rejected")
+	}
+}
+
+func TestSessionSlidesOnActivity(t *testing.T) {
+	for _, tc := range []struct {
+		remember bool
+		lifetime time.Duration
+	}{
+		{remember: false, lifetime: time.Hour},
+		{remember: true, lifetime: 24 * time.Hour},
+	} {
+		s := newTestAuth(t).(*magicLinksSvc)
+		cookie, err := s.LoggedIn(httptest.NewRequest(http.MethodGet, "/", nil), Claims{Email: "user@example.com", Remember: tc.remember})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		claims, err := s.validate(cookie.Value, tokenTypeSession)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lifetime := time.Until(claims.ExpiresAt); lifetime < tc.lifetime-time.Minute || lifetime > tc.lifetime {
+			t.Errorf("remember %v: expected session to last %v, got %v", tc.remember, tc.lifetime, lifetime)
+		}
+
+		// A session with most of its lifetime left is not renewed.
+		if email, renewed, err := s.RefreshSession(requestWithCookie(cookie.Value)); err != nil || email != "user@example.com" || renewed != nil {
+			t.Errorf("remember %v: expected no renewal of a fresh session, got %q, %v, %v", tc.remember, email, renewed, err)
+		}
+
+		// The same session after more than half its lifetime of activity.
+		aged, _, err := s.sign(tokenTypeSession, claims.ID, claims.Email, claims.Remember, tc.lifetime/4)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		email, renewed, err := s.RefreshSession(requestWithCookie(aged))
+		if err != nil || email != "user@example.com" || renewed == nil {
+			t.Fatalf("remember %v: expected the session to be renewed, got %q, %v, %v", tc.remember, email, renewed, err)
+		}
+		renewedClaims, err := s.validate(renewed.Value, tokenTypeSession)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if renewedClaims.ID != claims.ID {
+			t.Errorf("remember %v: expected renewal to keep session %s, got %s", tc.remember, claims.ID, renewedClaims.ID)
+		}
+		if lifetime := time.Until(renewedClaims.ExpiresAt); lifetime < tc.lifetime-time.Minute {
+			t.Errorf("remember %v: expected renewed session to last %v, got %v", tc.remember, tc.lifetime, lifetime)
+		}
+		if tc.remember != !renewed.Expires.IsZero() {
+			t.Errorf("remember %v: unexpected cookie expiry %v", tc.remember, renewed.Expires)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package certreloader serves a TLS certificate from files on disk and
+// swaps it when the files change, without restarting the server.
+package certreloader
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settle is how long to wait after a file event before reloading, so that
+// certificate and key written one after the other are picked up together.
+const settle = 500 * time.Millisecond
+
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// New loads the certificate and key, failing if they don't form a pair.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On failure the previous certificate stays
+// in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate. Connections that
+// are already established keep the certificate they were set up with.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP and whenever the files change,
+// until ctx is done. The directories are watched rather than the files so
+// that replacements by rename, as done by certbot or Kubernetes secrets,
+// are noticed.
+func (r *Reloader) Watch(ctx context.Context, logger *slog.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch certificate files: %w", err)
+	}
+	dirs := map[string]bool{
+		filepath.Dir(r.certFile): true,
+		filepath.Dir(r.keyFile):  true,
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("could not watch %s: %w", dir, err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+
+		reload := func(reason string) {
+			if err := r.Reload(); err != nil {
+				logger.Error("failed to reload TLS certificate, keeping the previous one", "reason", reason, "error", err)
+				return
+			}
+			logger.Info("reloaded TLS certificate", "reason", reason)
+		}
+
+		timer := time.NewTimer(settle)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-hup:
+				reload("SIGHUP")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) {
+					continue
+				}
+				timer.Reset(settle)
+			case <-timer.C:
+				reload("file change")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("error watching TLS certificate files", "error", err)
+			}
+		}
+	}()
+	return nil
+}
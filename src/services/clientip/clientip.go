@@ -0,0 +1,125 @@
+// Package clientip finds the address a request comes from when it is
+// passed on by reverse proxies. Forwarding headers are only believed when
+// set by a trusted proxy, as clients can send them too.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// New trusts the proxies at the given IP addresses or CIDR ranges. Peers
+// connected through a unix socket are always trusted, since only local
+// processes allowed by the socket's permissions can reach it.
+func New(trusted []string) (*Resolver, error) {
+	res := &Resolver{}
+	for _, entry := range trusted {
+		entry = strings.TrimSpace(entry)
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q is neither an IP address nor a CIDR range", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		res.trusted = append(res.trusted, prefix.Masked())
+	}
+	return res, nil
+}
+
+// ClientIP returns the address r comes from. If the peer is a trusted
+// proxy, that is the last address in the Forwarded or, without it, the
+// X-Forwarded-For header that isn't a trusted proxy itself.
+func (res *Resolver) ClientIP(r *http.Request) string {
+	peer, trusted := res.peer(r.RemoteAddr)
+	if !trusted {
+		return peer
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Such as "unknown" or an obfuscated identifier, which
+			// still tells clients apart.
+			return hops[i]
+		}
+		if i == 0 || !res.trusts(addr) {
+			return addr.Unmap().String()
+		}
+	}
+	return peer
+}
+
+// peer returns the address of the connection's peer, and whether it is a
+// trusted proxy.
+func (res *Resolver) peer(remoteAddr string) (string, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// Unix socket peers have no host and port.
+		return remoteAddr, true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host, false
+	}
+	return host, res.trusts(addr)
+}
+
+func (res *Resolver) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= addresses of Forwarded headers (RFC 7239),
+// without ports.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				node = strings.Trim(node, `"`)
+				if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+				if node = strings.Trim(node, "[]"); node != "" {
+					hops = append(hops, node)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses of X-Forwarded-For headers.
+func xForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,50 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	res, err := New([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "192.0.2.1"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"proxied", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed by client", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}}, "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2", "10.0.0.3"}}, "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.2"}}, "10.0.0.2"},
+		{"trusted IPv6 peer", "[2001:db8::1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=203.0.113.9, for="[2001:db8:cafe::17]:4711";proto=https`}}, "2001:db8:cafe::17"},
+		{"forwarded before x-forwarded-for", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.7"},
+		{"unix socket", "@", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"unix socket without header", "@", nil, "@"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for key, values := range tc.header {
+			r.Header[key] = values
+		}
+		if got := res.ClientIP(r); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNewRejectsInvalidProxies(t *testing.T) {
+	if _, err := New([]string{"proxy.example.com"}); err == nil {
+		t.Error("expected error for a host name")
+	}
+}
@@ -1,38 +1,131 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/erkannt/rechenschaftspflicht/services/admintokens"
+	"github.com/erkannt/rechenschaftspflicht/services/clientip"
 	"github.com/erkannt/rechenschaftspflicht/services/config/env"
+	"github.com/erkannt/rechenschaftspflicht/services/keyring"
 )
 
 type Problems map[string]string
 
 type Config struct {
-	JWTSecret   string `env:"JWT_SECRET"`
-	BearerToken string `env:"BEARER_TOKEN"`
-	SMTPHost    string `env:"SMTP_HOST"`
-	SMTPPort    string `env:"SMTP_PORT"`
-	SMTPUser    string `env:"SMTP_USER"`
-	SMTPPass    string `env:"SMTP_PASS"`
-	SMTPFrom    string `env:"SMTP_FROM"`
-	AppOrigin   string `env:"APP_ORIGIN"`
-	SqlitePath  string `env:"SQLITE_PATH"`
+	JWTSecret    string `env:"JWT_SECRET" secret:"true"`
+	BearerToken  string `env:"BEARER_TOKEN" secret:"true"`
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     string `env:"SMTP_PORT"`
+	SMTPUser     string `env:"SMTP_USER"`
+	SMTPPass     string `env:"SMTP_PASS" secret:"true"`
+	SMTPFrom     string `env:"SMTP_FROM"`
+	AppOrigin    string `env:"APP_ORIGIN"`
+	SqlitePath   string `env:"SQLITE_PATH"`
+	LogLevel     string `env:"LOG_LEVEL"`
+	LogFormat    string `env:"LOG_FORMAT"`
+	OTLPEndpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ListenAddr   string `env:"LISTEN_ADDR"`
+	SocketMode   string `env:"SOCKET_MODE"`
+	TLSCertFile  string `env:"TLS_CERT_FILE"`
+	TLSKeyFile   string `env:"TLS_KEY_FILE"`
+	// HTTPRedirectAddr, if set, is a host:port on which plain HTTP
+	// requests are redirected to APP_ORIGIN. Requires TLS.
+	HTTPRedirectAddr string `env:"HTTP_REDIRECT_ADDR"`
+	// TrustedProxies are the IP addresses or CIDR ranges of reverse
+	// proxies whose Forwarded and X-Forwarded-For headers name the client.
+	// Proxies connecting through a unix socket are always trusted.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+
+	// MagicLinkTTL is how long a login link stays valid, SessionTTL how
+	// long a session lasts without activity, and RememberDeviceTTL the
+	// same for sessions started with "remember this device".
+	MagicLinkTTL      time.Duration `env:"MAGIC_LINK_TTL"`
+	SessionTTL        time.Duration `env:"SESSION_TTL"`
+	RememberDeviceTTL time.Duration `env:"REMEMBER_DEVICE_TTL"`
+	// InvalidateOlderLinks makes requesting a magic link revoke the
+	// user's links that haven't been used yet.
+	InvalidateOlderLinks bool `env:"INVALIDATE_OLDER_LINKS"`
+
+	// AdminTokens are "name:token" bearer tokens for the admin API, each
+	// valid until removed, so tokens can be rotated one at a time. A token
+	// can be given by its hash instead, as "name:sha256:<hex>". The legacy
+	// BearerToken, which is always plain text, is named "default".
+	AdminTokens []string `env:"ADMIN_TOKENS" secret:"true"`
+
+	// JWTKeys are "id:secret" signing keys. JWTActiveKey names the one new
+	// tokens are signed with, by default the first; the others, and
+	// JWTSecret, only verify tokens issued before a rotation.
+	JWTKeys      []string `env:"JWT_KEYS" secret:"true"`
+	JWTActiveKey string   `env:"JWT_ACTIVE_KEY"`
+
+	// LoginLimitPerEmail and LoginLimitPerIP are how many logins may be
+	// requested before further requests have to wait, exponentially
+	// longer each time, until there were none for LoginLimitWindow.
+	// MaxOutstandingLinks caps the unused links a user can have. Zero
+	// disables a limit, but LoginLimitWindow must be set regardless.
+	LoginLimitPerEmail  int           `env:"LOGIN_LIMIT_PER_EMAIL"`
+	LoginLimitPerIP     int           `env:"LOGIN_LIMIT_PER_IP"`
+	LoginLimitWindow    time.Duration `env:"LOGIN_LIMIT_WINDOW"`
+	MaxOutstandingLinks int           `env:"MAX_OUTSTANDING_LINKS"`
+
+	// OIDCIssuer, if set, lets users log in through that OpenID Connect
+	// provider, found via discovery. Register APP_ORIGIN/login/oidc/callback
+	// as the client's redirect URI. OIDCProviderName labels the login
+	// button.
+	OIDCIssuer       string `env:"OIDC_ISSUER"`
+	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET" secret:"true"`
+	OIDCProviderName string `env:"OIDC_PROVIDER_NAME"`
+
+	// TOTPRequiredRoles are the roles whose users must log in with a TOTP
+	// second factor, none by default. Other users can opt in on the
+	// two-factor page.
+	TOTPRequiredRoles []string `env:"TOTP_REQUIRED_ROLES"`
 }
 
 var defaultConfig = Config{
 	SqlitePath: "data/state.db",
+	LogLevel:   "info",
+	LogFormat:  "json",
+	ListenAddr: ":8080",
+	SocketMode: "0660",
+
+	MagicLinkTTL:      15 * time.Minute,
+	SessionTTL:        24 * time.Hour,
+	RememberDeviceTTL: 30 * 24 * time.Hour,
+
+	LoginLimitPerEmail:  3,
+	LoginLimitPerIP:     20,
+	LoginLimitWindow:    time.Hour,
+	MaxOutstandingLinks: 3,
+
+	OIDCProviderName: "single sign-on",
 }
 
 func (c Config) Valid() Problems {
 	problems := Problems{}
 
-	if c.JWTSecret == "" {
-		problems["JWTSecret"] = "JWT_SECRET is required"
+	if c.JWTSecret == "" && len(c.JWTKeys) == 0 {
+		problems["JWTSecret"] = "JWT_SECRET or JWT_KEYS is required"
+	} else if _, err := c.Keyring(); err != nil {
+		problems["JWTKeys"] = err.Error()
 	}
-	if c.BearerToken == "" {
-		problems["BearerToken"] = "BEARER_TOKEN is required"
+	if c.BearerToken == "" && len(c.AdminTokens) == 0 {
+		problems["BearerToken"] = "BEARER_TOKEN or ADMIN_TOKENS is required"
+	} else if _, err := c.AdminTokenSet(); err != nil {
+		problems["AdminTokens"] = err.Error()
+	}
+	if _, err := c.ClientIPs(); err != nil {
+		problems["TrustedProxies"] = err.Error()
 	}
 	if c.SMTPHost == "" {
 		problems["SMTPHost"] = "SMTP_HOST is required"
@@ -46,10 +139,125 @@ func (c Config) Valid() Problems {
 	if c.AppOrigin == "" {
 		problems["AppOrigin"] = "APP_ORIGIN is required"
 	}
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problems["LogLevel"] = "LOG_LEVEL must be one of debug, info, warn or error"
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "json", "text":
+	default:
+		problems["LogFormat"] = "LOG_FORMAT must be json or text"
+	}
+	if problem := validListenAddr(c.ListenAddr); problem != "" {
+		problems["ListenAddr"] = problem
+	}
+	if c.SocketMode != "" {
+		if mode, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil || mode > 0o777 {
+			problems["SocketMode"] = "SOCKET_MODE must be octal permissions such as 0660"
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems["TLS"] = "TLS_CERT_FILE and TLS_KEY_FILE must be set together"
+	}
+	if c.HTTPRedirectAddr != "" {
+		if !c.TLSEnabled() {
+			problems["HTTPRedirectAddr"] = "HTTP_REDIRECT_ADDR requires TLS_CERT_FILE and TLS_KEY_FILE"
+		} else if _, port, err := net.SplitHostPort(c.HTTPRedirectAddr); err != nil || port == "" {
+			problems["HTTPRedirectAddr"] = "HTTP_REDIRECT_ADDR must be host:port"
+		}
+	}
+	if c.MagicLinkTTL <= 0 {
+		problems["MagicLinkTTL"] = "MAGIC_LINK_TTL must be positive"
+	}
+	if c.SessionTTL <= 0 {
+		problems["SessionTTL"] = "SESSION_TTL must be positive"
+	}
+	if c.RememberDeviceTTL < c.SessionTTL {
+		problems["RememberDeviceTTL"] = "REMEMBER_DEVICE_TTL must not be shorter than SESSION_TTL"
+	}
+	if c.LoginLimitPerEmail < 0 {
+		problems["LoginLimitPerEmail"] = "LOGIN_LIMIT_PER_EMAIL must not be negative"
+	}
+	if c.LoginLimitPerIP < 0 {
+		problems["LoginLimitPerIP"] = "LOGIN_LIMIT_PER_IP must not be negative"
+	}
+	// The second factor is always limited per user, so the window is
+	// needed even with the other login limits disabled.
+	if c.LoginLimitWindow <= 0 {
+		problems["LoginLimitWindow"] = "LOGIN_LIMIT_WINDOW must be positive"
+	}
+	if c.MaxOutstandingLinks < 0 {
+		problems["MaxOutstandingLinks"] = "MAX_OUTSTANDING_LINKS must not be negative"
+	}
+	if c.OIDCEnabled() {
+		if u, err := url.Parse(c.OIDCIssuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems["OIDCIssuer"] = "OIDC_ISSUER must be an http(s) URL"
+		}
+		if c.OIDCClientID == "" {
+			problems["OIDCClientID"] = "OIDC_CLIENT_ID is required with OIDC_ISSUER"
+		}
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems["OTLPEndpoint"] = "OTEL_EXPORTER_OTLP_ENDPOINT must be an http(s) URL"
+		}
+	}
 
 	return problems
 }
 
+// Keyring returns the keys for signing and verifying tokens.
+func (c Config) Keyring() (*keyring.Keyring, error) {
+	return keyring.New(c.JWTKeys, c.JWTActiveKey, c.JWTSecret)
+}
+
+// AdminTokenSet returns the tokens that authorize the admin API.
+func (c Config) AdminTokenSet() (*admintokens.Tokens, error) {
+	return admintokens.New(c.AdminTokens, c.BearerToken)
+}
+
+// ClientIPs returns the resolver of client addresses behind the trusted
+// proxies.
+func (c Config) ClientIPs() (*clientip.Resolver, error) {
+	return clientip.New(c.TrustedProxies)
+}
+
+// TLSEnabled reports whether the server terminates TLS itself.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// OIDCEnabled reports whether users can log in through an OpenID Connect
+// provider.
+func (c Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != ""
+}
+
+// validListenAddr returns a problem description unless addr is host:port,
+// unix:<path>, systemd or systemd:<name>.
+func validListenAddr(addr string) string {
+	switch {
+	case addr == "":
+		return "LISTEN_ADDR is required"
+	case strings.HasPrefix(addr, "unix:"):
+		if strings.TrimPrefix(addr, "unix:") == "" {
+			return "LISTEN_ADDR unix: needs a socket path"
+		}
+	case addr == "systemd", strings.HasPrefix(addr, "systemd:"):
+	default:
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return "LISTEN_ADDR must be host:port, unix:<path>, systemd or systemd:<name>"
+		}
+	}
+	return ""
+}
+
+// Err returns an error listing the problems, or nil if there are none.
+func (p Problems) Err() error {
+	return problemsToError(p)
+}
+
 func problemsToError(problems Problems) error {
 	if len(problems) == 0 {
 		return nil
@@ -62,16 +270,114 @@ func problemsToError(problems Problems) error {
 	return fmt.Errorf("validation failed: %s", strings.Join(msgs, ", "))
 }
 
-func LoadFromEnv(getenv func(string) string) (Config, error) {
+// Load builds the config from, in increasing order of precedence, the
+// defaults, the TOML or YAML file named by CONFIG_FILE and environment
+// variables. Every setting can also be read from the file named by its
+// _FILE variant, e.g. JWT_SECRET_FILE=/run/secrets/jwt_secret, to keep
+// secrets out of the environment.
+func Load(getenv func(string) string) (Config, error) {
+	cfg, err := Read(getenv)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := problemsToError(cfg.Valid()); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// Read builds the config like Load, but doesn't validate it.
+func Read(getenv func(string) string) (Config, error) {
 	cfg := defaultConfig
 
-	if err := env.Parse(getenv, &cfg); err != nil {
-		return Config{}, fmt.Errorf("failed to parse env: %w", err)
+	src := &sources{getenv: getenv}
+	if path := getenv("CONFIG_FILE"); path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+		src.file = values
 	}
 
-	if err := problemsToError(cfg.Valid()); err != nil {
+	if err := env.Parse(src.lookup, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to parse env: %w", err)
+	}
+	if err := errors.Join(src.errs...); err != nil {
 		return Config{}, err
 	}
 
 	return cfg, nil
 }
+
+// sources looks up a setting in the environment, then in the file named by
+// its _FILE variant, then in the config file.
+type sources struct {
+	getenv func(string) string
+	file   map[string]string
+	errs   []error
+}
+
+func (s *sources) lookup(key string) string {
+	value, secretFile := s.getenv(key), s.getenv(key+"_FILE")
+	switch {
+	case value != "" && secretFile != "":
+		s.errs = append(s.errs, fmt.Errorf("%s and %s_FILE are both set", key, key))
+		return value
+	case value != "":
+		return value
+	case secretFile != "":
+		data, err := os.ReadFile(secretFile)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("could not read %s_FILE: %w", key, err))
+			return ""
+		}
+		return strings.TrimRight(string(data), "\r\n")
+	}
+	return s.file[key]
+}
+
+// Print writes the config as environment variable assignments, with
+// secrets that are set masked.
+func (c Config) Print(w io.Writer) error {
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		value := formatValue(v.Field(i))
+		if field.Tag.Get("secret") == "true" && !isEmpty(v.Field(i)) {
+			value = "********"
+		}
+		if _, err := fmt.Fprintf(w, "%s=%s\n", key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatValue formats v the way it is read from the environment, with
+// slices joined by commas.
+func formatValue(v reflect.Value) string {
+	if v.Kind() != reflect.Slice {
+		return fmt.Sprint(v.Interface())
+	}
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(items, ",")
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigValid(t *testing.T) {
@@ -12,6 +18,12 @@ func TestConfigValid(t *testing.T) {
 		SMTPPort:    "587",
 		SMTPFrom:    "from@test.com",
 		AppOrigin:   "http://localhost:3000",
+		ListenAddr:  ":8080",
+
+		MagicLinkTTL:      15 * time.Minute,
+		SessionTTL:        time.Hour,
+		RememberDeviceTTL: time.Hour,
+		LoginLimitWindow:  time.Hour,
 	}
 
 	problems := cfg.Valid()
@@ -24,8 +36,8 @@ func TestConfigValidMissingFields(t *testing.T) {
 	cfg := Config{}
 
 	problems := cfg.Valid()
-	if len(problems) != 6 {
-		t.Errorf("expected 6 problems, got %d: %v", len(problems), problems)
+	if len(problems) != 10 {
+		t.Errorf("expected 10 problems, got %d: %v", len(problems), problems)
 	}
 
 	if _, ok := problems["JWTSecret"]; !ok {
@@ -46,6 +58,135 @@ func TestConfigValidMissingFields(t *testing.T) {
 	if _, ok := problems["AppOrigin"]; !ok {
 		t.Error("expected AppOrigin problem")
 	}
+	if _, ok := problems["ListenAddr"]; !ok {
+		t.Error("expected ListenAddr problem")
+	}
+	if _, ok := problems["MagicLinkTTL"]; !ok {
+		t.Error("expected MagicLinkTTL problem")
+	}
+	if _, ok := problems["SessionTTL"]; !ok {
+		t.Error("expected SessionTTL problem")
+	}
+	if _, ok := problems["LoginLimitWindow"]; !ok {
+		t.Error("expected LoginLimitWindow problem")
+	}
+}
+
+func TestConfigValidLoginLimitWindow(t *testing.T) {
+	cfg := defaultConfig
+	cfg.LoginLimitPerEmail = 0
+	cfg.LoginLimitPerIP = 0
+	cfg.LoginLimitWindow = 0
+	if _, ok := cfg.Valid()["LoginLimitWindow"]; !ok {
+		t.Error("expected LoginLimitWindow problem with limits disabled, as second factors are still limited")
+	}
+
+	cfg.LoginLimitPerEmail = 3
+	if _, ok := cfg.Valid()["LoginLimitWindow"]; !ok {
+		t.Error("expected LoginLimitWindow problem with a login limit enabled")
+	}
+
+	cfg.LoginLimitWindow = time.Minute
+	if problem, ok := cfg.Valid()["LoginLimitWindow"]; ok {
+		t.Errorf("unexpected problem: %s", problem)
+	}
+}
+
+func TestConfigValidTrustedProxies(t *testing.T) {
+	cfg, err := Read(validEnv(map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,192.0.2.1,::1"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if problem, ok := cfg.Valid()["TrustedProxies"]; ok {
+		t.Errorf("unexpected problem: %s", problem)
+	}
+
+	cfg.TrustedProxies = []string{"proxy.example.com"}
+	if _, ok := cfg.Valid()["TrustedProxies"]; !ok {
+		t.Error("expected TrustedProxies problem for a host name")
+	}
+}
+
+func TestTOTPRequiredRoles(t *testing.T) {
+	cases := map[string][]string{
+		"":              nil,
+		"admin":         {"admin"},
+		"admin,auditor": {"admin", "auditor"},
+	}
+	for value, want := range cases {
+		cfg, err := Read(validEnv(map[string]string{"TOTP_REQUIRED_ROLES": value}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !slices.Equal(cfg.TOTPRequiredRoles, want) {
+			t.Errorf("%q: expected %v, got %v", value, want, cfg.TOTPRequiredRoles)
+		}
+	}
+}
+
+func TestConfigValidListenAddr(t *testing.T) {
+	valid := []string{":8080", "127.0.0.1:8080", "[::1]:8080", "unix:/run/app.sock", "systemd", "systemd:http"}
+	invalid := []string{"8080", "localhost", "unix:", "127.0.0.1:"}
+
+	for _, addr := range valid {
+		if problem := validListenAddr(addr); problem != "" {
+			t.Errorf("expected %q to be valid, got: %s", addr, problem)
+		}
+	}
+	for _, addr := range invalid {
+		if validListenAddr(addr) == "" {
+			t.Errorf("expected %q to be invalid", addr)
+		}
+	}
+}
+
+func TestConfigValidSocketMode(t *testing.T) {
+	cfg := defaultConfig
+	cfg.SocketMode = "0999"
+	if _, ok := cfg.Valid()["SocketMode"]; !ok {
+		t.Error("expected SocketMode problem for non-octal mode")
+	}
+
+	cfg.SocketMode = "0660"
+	if _, ok := cfg.Valid()["SocketMode"]; ok {
+		t.Error("expected no SocketMode problem for 0660")
+	}
+}
+
+func TestConfigValidOIDC(t *testing.T) {
+	cfg := defaultConfig
+	cfg.OIDCIssuer = "https://id.example.com"
+	if _, ok := cfg.Valid()["OIDCClientID"]; !ok {
+		t.Error("expected OIDCClientID problem without a client ID")
+	}
+
+	cfg.OIDCClientID = "rechenschaftspflicht"
+	problems := cfg.Valid()
+	if _, ok := problems["OIDCIssuer"]; ok {
+		t.Errorf("expected no OIDCIssuer problem, got: %s", problems["OIDCIssuer"])
+	}
+
+	cfg.OIDCIssuer = "id.example.com"
+	if _, ok := cfg.Valid()["OIDCIssuer"]; !ok {
+		t.Error("expected OIDCIssuer problem for an issuer without scheme")
+	}
+}
+
+func TestConfigValidAdminTokens(t *testing.T) {
+	cfg := defaultConfig
+	cfg.AdminTokens = []string{"ci:token", "ops:sha256:" + strings.Repeat("ab", 32)}
+	problems := cfg.Valid()
+	if _, ok := problems["BearerToken"]; ok {
+		t.Errorf("expected ADMIN_TOKENS to stand in for BEARER_TOKEN, got: %s", problems["BearerToken"])
+	}
+	if _, ok := problems["AdminTokens"]; ok {
+		t.Errorf("expected no AdminTokens problem, got: %s", problems["AdminTokens"])
+	}
+
+	cfg.AdminTokens = []string{"ci:sha256:abc"}
+	if _, ok := cfg.Valid()["AdminTokens"]; !ok {
+		t.Error("expected AdminTokens problem for a malformed hash")
+	}
 }
 
 func TestProblemsToError(t *testing.T) {
@@ -74,3 +215,141 @@ func TestProblemsToErrorNil(t *testing.T) {
 		t.Errorf("expected nil error, got '%s'", err.Error())
 	}
 }
+
+func validEnv(extra map[string]string) func(string) string {
+	m := map[string]string{
+		"JWT_SECRET":   "secret",
+		"BEARER_TOKEN": "token",
+		"SMTP_HOST":    "localhost",
+		"SMTP_PORT":    "587",
+		"SMTP_FROM":    "from@test.com",
+		"APP_ORIGIN":   "http://localhost:3000",
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return func(key string) string { return m[key] }
+}
+
+func TestLoadLayersFileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	content := "log_level = \"debug\"\n\n[smtp]\nhost = \"mail.example.com\"\nuser = \"mailer\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(validEnv(map[string]string{"CONFIG_FILE": path, "SMTP_HOST": ""}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SMTPHost != "mail.example.com" || cfg.SMTPUser != "mailer" || cfg.LogLevel != "debug" {
+		t.Errorf("expected values from file, got %+v", cfg)
+	}
+
+	cfg, err = Load(validEnv(map[string]string{"CONFIG_FILE": path, "LOG_LEVEL": "warn"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LogLevel != "warn" {
+		t.Errorf("expected env to override file, got %q", cfg.LogLevel)
+	}
+}
+
+func TestLoadRejectsUnknownFileSetting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("smtp:\n  hots: localhost\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(validEnv(map[string]string{"CONFIG_FILE": path})); err == nil {
+		t.Error("expected error for unknown setting")
+	}
+}
+
+func TestLoadReadsSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(validEnv(map[string]string{"JWT_SECRET": "", "JWT_SECRET_FILE": path}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.JWTSecret != "from-file" {
+		t.Errorf("expected secret from file, got %q", cfg.JWTSecret)
+	}
+
+	if _, err := Load(validEnv(map[string]string{"JWT_SECRET_FILE": path})); err == nil {
+		t.Error("expected error when both JWT_SECRET and JWT_SECRET_FILE are set")
+	}
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	cfg, err := Load(validEnv(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "JWT_SECRET=secret") || strings.Contains(out, "BEARER_TOKEN=token") {
+		t.Errorf("secrets not masked:\n%s", out)
+	}
+	if !strings.Contains(out, "SMTP_HOST=localhost") {
+		t.Errorf("expected SMTP_HOST in output:\n%s", out)
+	}
+}
+
+func TestPrintShowsEmptySecrets(t *testing.T) {
+	cfg, err := Load(validEnv(map[string]string{"JWT_KEYS": "k1:key"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "JWT_KEYS=********\n") {
+		t.Errorf("expected JWT_KEYS to be masked:\n%s", out)
+	}
+	if !strings.Contains(out, "ADMIN_TOKENS=\n") {
+		t.Errorf("expected empty ADMIN_TOKENS to be shown as empty:\n%s", out)
+	}
+}
+
+func TestPrintJoinsSlicesWithCommas(t *testing.T) {
+	getenv := validEnv(map[string]string{"TOTP_REQUIRED_ROLES": "admin,auditor"})
+	cfg, err := Load(getenv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "TOTP_REQUIRED_ROLES=admin,auditor\n") {
+		t.Errorf("expected TOTP_REQUIRED_ROLES to be joined with commas:\n%s", buf.String())
+	}
+}
+
+func TestReadDoesNotValidate(t *testing.T) {
+	getenv := validEnv(map[string]string{"SMTP_HOST": ""})
+
+	cfg, err := Read(getenv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Valid().Err() == nil {
+		t.Error("expected problems with the config")
+	}
+	if _, err := Load(getenv); err == nil {
+		t.Error("expected Load to reject the config")
+	}
+}
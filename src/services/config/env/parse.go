@@ -1,29 +1,204 @@
+// Package env fills structs from environment variables.
+//
+// Fields are mapped with the env tag, which names the variable and may add
+// options after a comma:
+//
+//	Port    int           `env:"PORT,default=8080"`
+//	Secret  string        `env:"SECRET,required"`
+//	Timeout time.Duration `env:"TIMEOUT"`
+//	Hosts   []string      `env:"HOSTS"`
+//	SMTP    SMTPConfig    `envPrefix:"SMTP_"`
+//
+// Supported kinds are strings, booleans, integers, floats, time.Duration
+// and slices of those, given as comma-separated lists. Struct fields with
+// an envPrefix tag, and embedded structs, are filled recursively with the
+// prefix prepended to the names of their fields.
+//
+// A variable that is unset or empty leaves the field untouched, unless the
+// tag has a default. The default option must come last, as everything
+// after "default=" is taken as the value.
 package env
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrNotStructPointer is returned when Parse is not given a pointer to a
+// struct.
+var ErrNotStructPointer = errors.New("env: expected a pointer to a struct")
+
+// ParseError describes a variable whose value could not be converted to
+// the type of its field.
+type ParseError struct {
+	Key   string
+	Value string
+	Type  reflect.Type
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("env: %s=%q is not a valid %s: %v", e.Key, e.Value, e.Type, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// RequiredError describes a required variable that is not set.
+type RequiredError struct {
+	Key string
+}
+
+func (e *RequiredError) Error() string {
+	return fmt.Sprintf("env: %s is required", e.Key)
+}
+
+// Parse fills the struct v points to from the variables returned by
+// getenv. All problems are collected and returned together.
 func Parse(getenv func(string) string, v any) error {
 	rv := reflect.ValueOf(v)
-	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrNotStructPointer
+	}
+
+	var errs []error
+	for _, f := range fields(rv.Elem().Type(), "", nil) {
+		value := getenv(f.key)
+		if value == "" {
+			if f.required {
+				errs = append(errs, &RequiredError{Key: f.key})
+				continue
+			}
+			if !f.hasDefault {
+				continue
+			}
+			value = f.defaultValue
+		}
+
+		field := rv.Elem().FieldByIndex(f.index)
+		if err := set(field, value); err != nil {
+			errs = append(errs, &ParseError{Key: f.key, Value: value, Type: field.Type(), Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Keys returns the environment variable names Parse reads into v.
+func Keys(v any) []string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
 		return nil
 	}
 
-	st := rv.Elem()
-	t := st.Type()
+	var keys []string
+	for _, f := range fields(t, "", nil) {
+		keys = append(keys, f.key)
+	}
+	return keys
+}
 
+type field struct {
+	index        []int
+	key          string
+	required     bool
+	hasDefault   bool
+	defaultValue string
+}
+
+func fields(t reflect.Type, prefix string, index []int) []field {
+	var out []field
 	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		tag := field.Tag.Get("env")
-		if tag == "" {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		idx := append(append([]int{}, index...), i)
+
+		tag, hasTag := sf.Tag.Lookup("env")
+		if !hasTag || tag == "" {
+			subPrefix, hasPrefix := sf.Tag.Lookup("envPrefix")
+			if sf.Type.Kind() == reflect.Struct && (hasPrefix || sf.Anonymous) {
+				out = append(out, fields(sf.Type, prefix+subPrefix, idx)...)
+			}
 			continue
 		}
 
-		if value := getenv(tag); value != "" {
-			st.Field(i).SetString(value)
+		name, options, _ := strings.Cut(tag, ",")
+		f := field{index: idx, key: prefix + name}
+		for options != "" {
+			var option string
+			if strings.HasPrefix(options, "default=") {
+				f.hasDefault, f.defaultValue = true, strings.TrimPrefix(options, "default=")
+				break
+			}
+			option, options, _ = strings.Cut(options, ",")
+			if option == "required" {
+				f.required = true
+			}
 		}
+		out = append(out, f)
 	}
+	return out
+}
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func set(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		parts := strings.Split(value, ",")
+		slice := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := set(slice.Index(i), strings.TrimSpace(part)); err != nil {
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported kind %s", v.Kind())
+	}
 	return nil
 }
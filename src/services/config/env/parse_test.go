@@ -1,7 +1,11 @@
 package env
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
@@ -56,3 +60,130 @@ func TestParseSkipsFieldsWithoutTag(t *testing.T) {
 		t.Errorf("expected '', got '%s'", cfg.FieldNoTag)
 	}
 }
+
+func TestParseTypedFields(t *testing.T) {
+	getenv := func(key string) string {
+		return map[string]string{
+			"PORT":    "8080",
+			"DEBUG":   "true",
+			"RATIO":   "0.5",
+			"TIMEOUT": "1m30s",
+			"HOSTS":   "a.example.com, b.example.com",
+			"CODES":   "1,2,3",
+		}[key]
+	}
+
+	type TestConfig struct {
+		Port    int           `env:"PORT"`
+		Debug   bool          `env:"DEBUG"`
+		Ratio   float64       `env:"RATIO"`
+		Timeout time.Duration `env:"TIMEOUT"`
+		Hosts   []string      `env:"HOSTS"`
+		Codes   []uint8       `env:"CODES"`
+	}
+
+	var cfg TestConfig
+	if err := Parse(getenv, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := TestConfig{
+		Port:    8080,
+		Debug:   true,
+		Ratio:   0.5,
+		Timeout: 90 * time.Second,
+		Hosts:   []string{"a.example.com", "b.example.com"},
+		Codes:   []uint8{1, 2, 3},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("expected %+v, got %+v", want, cfg)
+	}
+}
+
+func TestParseNestedStructsWithPrefix(t *testing.T) {
+	getenv := func(key string) string {
+		return map[string]string{"SMTP_HOST": "localhost", "SMTP_PORT": "25"}[key]
+	}
+
+	type SMTP struct {
+		Host string `env:"HOST"`
+		Port int    `env:"PORT"`
+	}
+	type TestConfig struct {
+		SMTP SMTP `envPrefix:"SMTP_"`
+	}
+
+	var cfg TestConfig
+	if err := Parse(getenv, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SMTP.Host != "localhost" || cfg.SMTP.Port != 25 {
+		t.Errorf("unexpected nested values: %+v", cfg.SMTP)
+	}
+
+	keys := Keys(TestConfig{})
+	if !reflect.DeepEqual(keys, []string{"SMTP_HOST", "SMTP_PORT"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestParseDefaultAndRequired(t *testing.T) {
+	getenv := func(key string) string { return "" }
+
+	type TestConfig struct {
+		Port  int      `env:"PORT,default=8080"`
+		Hosts []string `env:"HOSTS,default=a,b"`
+		Name  string   `env:"NAME,required"`
+	}
+
+	var cfg TestConfig
+	err := Parse(getenv, &cfg)
+
+	var required *RequiredError
+	if !errors.As(err, &required) || required.Key != "NAME" {
+		t.Errorf("expected RequiredError for NAME, got %v", err)
+	}
+	if cfg.Port != 8080 {
+		t.Errorf("expected default port, got %d", cfg.Port)
+	}
+	if !reflect.DeepEqual(cfg.Hosts, []string{"a", "b"}) {
+		t.Errorf("expected default hosts, got %v", cfg.Hosts)
+	}
+}
+
+func TestParseAggregatesErrors(t *testing.T) {
+	getenv := func(key string) string {
+		return map[string]string{"PORT": "eighty", "DEBUG": "maybe"}[key]
+	}
+
+	type TestConfig struct {
+		Port  int  `env:"PORT"`
+		Debug bool `env:"DEBUG"`
+	}
+
+	var cfg TestConfig
+	err := Parse(getenv, &cfg)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected ParseError, got %T", err)
+	}
+	for _, key := range []string{"PORT", "DEBUG"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected error to mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestParseRejectsNonPointer(t *testing.T) {
+	type TestConfig struct {
+		Field string `env:"FIELD"`
+	}
+
+	if err := Parse(func(string) string { return "" }, TestConfig{}); !errors.Is(err, ErrNotStructPointer) {
+		t.Errorf("expected ErrNotStructPointer, got %v", err)
+	}
+}
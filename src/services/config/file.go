@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/erkannt/rechenschaftspflicht/services/config/env"
+	"gopkg.in/yaml.v3"
+)
+
+// readFile reads a TOML or YAML config file into values keyed by
+// environment variable name. Keys are matched case-insensitively and
+// tables are joined with underscores, so
+//
+//	[smtp]
+//	host = "localhost"
+//
+// sets SMTP_HOST.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q, use .toml, .yaml or .yml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", doc, values)
+
+	known := env.Keys(Config{})
+	for key := range values {
+		if !slices.Contains(known, key) {
+			return nil, fmt.Errorf("unknown setting %q in %s", key, path)
+		}
+	}
+	return values, nil
+}
+
+func flatten(prefix string, doc map[string]any, values map[string]string) {
+	for key, value := range doc {
+		name := strings.ToUpper(prefix + key)
+		switch v := value.(type) {
+		case map[string]any:
+			flatten(name+"_", v, values)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package csrf implements double-submit tokens: a random token is kept in
+// a cookie and must be echoed in every state-changing form post, which a
+// cross-site page can't do as it can't read the cookie. Origin or Referer
+// headers are checked as well where browsers send them.
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// CookieName is the cookie holding the token.
+	CookieName = "csrf"
+	// FieldName is the form field forms echo the token in.
+	FieldName = "csrf_token"
+	// Header can carry the token instead of the form field.
+	Header = "X-CSRF-Token"
+)
+
+var (
+	ErrCrossOrigin  = errors.New("request from another origin")
+	ErrMissingToken = errors.New("CSRF token missing")
+	ErrBadToken     = errors.New("CSRF token does not match")
+)
+
+type contextKey struct{}
+
+// New returns a random token.
+func New() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, contextKey{}, token)
+}
+
+// Token returns the token forms rendered for the request must include.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(contextKey{}).(string)
+	return token
+}
+
+// Safe reports whether the method must not change state, and so needs no
+// token.
+func Safe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Verify checks that a state-changing request comes from appOrigin and
+// echoes cookieToken.
+func Verify(r *http.Request, appOrigin, cookieToken string) error {
+	if err := checkOrigin(r, appOrigin); err != nil {
+		return err
+	}
+
+	sent := r.Header.Get(Header)
+	if sent == "" {
+		sent = r.PostFormValue(FieldName)
+	}
+	if cookieToken == "" || sent == "" {
+		return ErrMissingToken
+	}
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(cookieToken)) != 1 {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// checkOrigin compares the Origin header, or failing that the Referer, to
+// appOrigin. Requests with neither are left to the token check, as some
+// browsers and privacy tools strip both.
+func checkOrigin(r *http.Request, appOrigin string) error {
+	want, err := url.Parse(appOrigin)
+	if err != nil {
+		return err
+	}
+
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return nil
+	}
+	got, err := url.Parse(source)
+	if err != nil || got.Scheme != want.Scheme || got.Host != want.Host {
+		return ErrCrossOrigin
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const appOrigin = "https://app.example.com"
+
+func post(token string, headers map[string]string) *http.Request {
+	form := url.Values{}
+	if token != "" {
+		form.Set(FieldName, token)
+	}
+	r := httptest.NewRequest(http.MethodPost, appOrigin+"/record-event", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	cases := map[string]struct {
+		r    *http.Request
+		want error
+	}{
+		"matching token":           {post("tok", nil), nil},
+		"same origin":              {post("tok", map[string]string{"Origin": appOrigin}), nil},
+		"same origin referer":      {post("tok", map[string]string{"Referer": appOrigin + "/record-event"}), nil},
+		"token in header":          {post("", map[string]string{Header: "tok"}), nil},
+		"missing token":            {post("", nil), ErrMissingToken},
+		"wrong token":              {post("other", nil), ErrBadToken},
+		"cross origin":             {post("tok", map[string]string{"Origin": "https://evil.example.com"}), ErrCrossOrigin},
+		"cross origin referer":     {post("tok", map[string]string{"Referer": "https://evil.example.com/"}), ErrCrossOrigin},
+		"downgraded scheme":        {post("tok", map[string]string{"Origin": "http://app.example.com"}), ErrCrossOrigin},
+		"null origin, bad referer": {post("tok", map[string]string{"Origin": "null", "Referer": "https://evil.example.com/"}), ErrCrossOrigin},
+	}
+	for name, c := range cases {
+		if err := Verify(c.r, appOrigin, "tok"); !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", name, c.want, err)
+		}
+	}
+}
+
+func TestVerifyWithoutCookie(t *testing.T) {
+	if err := Verify(post("tok", nil), appOrigin, ""); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("expected %v, got %v", ErrMissingToken, err)
+	}
+}
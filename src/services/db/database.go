@@ -3,13 +3,14 @@ package database
 import (
 	"database/sql"
 	"os"
+	"path/filepath"
 
 	"github.com/erkannt/rechenschaftspflicht/services/config"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func InitDB(config config.Config) (*sql.DB, error) {
-	if err := os.MkdirAll("data", os.ModePerm); err != nil {
+	if err := os.MkdirAll(filepath.Dir(config.SqlitePath), os.ModePerm); err != nil {
 		return nil, err
 	}
 
@@ -29,6 +30,11 @@ func InitDB(config config.Config) (*sql.DB, error) {
 	);
 	`
 
+	// Serves the per user and tag aggregates of the event metrics.
+	createEventsByUserTagIndex := `
+	CREATE INDEX IF NOT EXISTS events_by_user_tag ON events (recordedBy, tag, sequence);
+	`
+
 	createUsersTable := `
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -37,12 +43,155 @@ func InitDB(config config.Config) (*sql.DB, error) {
 	);
 	`
 
+	createFeedTokensTable := `
+	CREATE TABLE IF NOT EXISTS feed_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT,
+		tokenHash TEXT UNIQUE,
+		createdAt TEXT,
+		revokedAt TEXT
+	);
+	`
+
+	createAPITokensTable := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		tokenHash TEXT UNIQUE,
+		scopes TEXT,
+		createdAt TEXT,
+		revokedAt TEXT
+	);
+	`
+
+	createMagicLinksTable := `
+	CREATE TABLE IF NOT EXISTS magic_links (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		createdAt TEXT,
+		expiresAt TEXT,
+		consumedAt TEXT,
+		revokedAt TEXT
+	);
+	`
+
+	createLoginCodesTable := `
+	CREATE TABLE IF NOT EXISTS login_codes (
+		linkId TEXT PRIMARY KEY,
+		codeHash TEXT,
+		remember INTEGER,
+		attempts INTEGER
+	);
+	`
+
+	createSessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		userAgent TEXT,
+		ip TEXT,
+		createdAt TEXT,
+		lastSeenAt TEXT,
+		expiresAt TEXT,
+		revokedAt TEXT
+	);
+	`
+
+	createPasskeyUsersTable := `
+	CREATE TABLE IF NOT EXISTS passkey_users (
+		email TEXT PRIMARY KEY,
+		handle BLOB UNIQUE
+	);
+	`
+
+	createPasskeysTable := `
+	CREATE TABLE IF NOT EXISTS passkeys (
+		id BLOB PRIMARY KEY,
+		email TEXT,
+		name TEXT,
+		credential TEXT,
+		createdAt TEXT,
+		lastUsedAt TEXT
+	);
+	`
+
+	createPasskeyCeremoniesTable := `
+	CREATE TABLE IF NOT EXISTS passkey_ceremonies (
+		id TEXT PRIMARY KEY,
+		data TEXT,
+		expiresAt TEXT
+	);
+	`
+
+	createUserRolesTable := `
+	CREATE TABLE IF NOT EXISTS user_roles (
+		email TEXT,
+		role TEXT,
+		PRIMARY KEY (email, role)
+	);
+	`
+
+	createTOTPTable := `
+	CREATE TABLE IF NOT EXISTS totp (
+		email TEXT PRIMARY KEY,
+		secret TEXT,
+		pendingSecret TEXT,
+		enrolledAt TEXT,
+		lastStep INTEGER
+	);
+	`
+
+	createRecoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		email TEXT,
+		codeHash TEXT,
+		usedAt TEXT,
+		PRIMARY KEY (email, codeHash)
+	);
+	`
+
 	if _, err = db.Exec(createEventsTable); err != nil {
 		return nil, err
 	}
+	if _, err = db.Exec(createEventsByUserTagIndex); err != nil {
+		return nil, err
+	}
 	if _, err = db.Exec(createUsersTable); err != nil {
 		return nil, err
 	}
+	if _, err = db.Exec(createFeedTokensTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createAPITokensTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createMagicLinksTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createLoginCodesTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createSessionsTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createPasskeyUsersTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createPasskeysTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createPasskeyCeremoniesTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createUserRolesTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createTOTPTable); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createRecoveryCodesTable); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
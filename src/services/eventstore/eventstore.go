@@ -1,12 +1,16 @@
 package eventstore
 
 import (
+	"context"
 	"database/sql"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Event struct {
+	ID         int64  `json:"id"`
 	Tag        string `json:"tag"`
 	Comment    string `json:"comment"`
 	Value      string `json:"value"`
@@ -14,9 +18,51 @@ type Event struct {
 	RecordedBy string `json:"recordedBy"`
 }
 
+// ParseRecordedAt parses an event's recordedAt timestamp, returning the zero
+// time if it can't be parsed. Timestamps without a timezone, as produced by
+// dummy-data-init.py, are read as UTC.
+func ParseRecordedAt(recordedAt string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, recordedAt); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Filter narrows down which events are returned. Zero values match everything.
+type Filter struct {
+	Tag        string
+	RecordedBy string // username, or email for events by unknown users
+	From       string // inclusive, YYYY-MM-DD
+	To         string // inclusive, YYYY-MM-DD
+	Limit      int    // 0 means no limit
+	Offset     int
+}
+
+// UnknownUser stands in for the username in stats of events recorded by
+// emails that have no user.
+const UnknownUser = "unknown"
+
+// TagStats aggregates the events of one username and tag. Latest and
+// LatestAt are empty if none of the events carries a value.
+type TagStats struct {
+	RecordedBy string // username, or UnknownUser
+	Tag        string
+	Count      int64
+	Sum        float64
+	Latest     string
+	LatestAt   string
+}
+
 type EventStore interface {
-	Record(event Event) error
-	GetAll() ([]Event, error)
+	Record(ctx context.Context, event Event) error
+	GetAll(ctx context.Context) ([]Event, error)
+	Find(ctx context.Context, filter Filter) ([]Event, error)
+	// Each calls fn for every matching event, newest first, without
+	// loading the full result set into memory.
+	Each(ctx context.Context, filter Filter, fn func(Event) error) error
+	Stats(ctx context.Context) ([]TagStats, error)
 }
 
 type SQLiteEventStore struct {
@@ -27,40 +73,147 @@ func NewEventStore(db *sql.DB) EventStore {
 	return &SQLiteEventStore{db: db}
 }
 
-func (s *SQLiteEventStore) Record(event Event) error {
+func (s *SQLiteEventStore) Record(ctx context.Context, event Event) error {
 	stmt := `INSERT INTO events (tag, comment, value, recordedAt, recordedBy) VALUES (?, ?, ?, ?, ?);`
-	_, err := s.db.Exec(stmt, event.Tag, event.Comment, event.Value, event.RecordedAt, event.RecordedBy)
+	_, err := s.db.ExecContext(ctx, stmt, event.Tag, event.Comment, event.Value, event.RecordedAt, event.RecordedBy)
 	return err
 }
 
-func (s *SQLiteEventStore) GetAll() ([]Event, error) {
-	rows, err := s.db.Query(`
-		SELECT e.tag, e.comment, e.value, e.recordedAt, u.username
+func (s *SQLiteEventStore) GetAll(ctx context.Context) ([]Event, error) {
+	return s.Find(ctx, Filter{})
+}
+
+func (s *SQLiteEventStore) Find(ctx context.Context, filter Filter) ([]Event, error) {
+	var events []Event
+	err := s.Each(ctx, filter, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *SQLiteEventStore) Each(ctx context.Context, filter Filter, fn func(Event) error) (err error) {
+	where, args := filter.where()
+	limit := ""
+	if filter.Limit > 0 {
+		limit = "LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT e.sequence, e.tag, e.comment, e.value, e.recordedAt, COALESCE(u.username, e.recordedBy)
 		FROM events e
 		LEFT JOIN users u ON e.recordedBy = u.email
-		ORDER BY e.sequence DESC;
-	`)
+		`+where+`
+		ORDER BY e.sequence DESC
+		`+limit+`;
+	`, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
 			err = closeErr
 		}
 	}()
 
-	var events []Event
 	for rows.Next() {
 		var e Event
-		if err := rows.Scan(&e.Tag, &e.Comment, &e.Value, &e.RecordedAt, &e.RecordedBy); err != nil {
-			return nil, err
+		if err := rows.Scan(&e.ID, &e.Tag, &e.Comment, &e.Value, &e.RecordedAt, &e.RecordedBy); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
 		}
-		events = append(events, e)
 	}
-	if err = rows.Err(); err != nil {
+	return rows.Err()
+}
+
+func (s *SQLiteEventStore) Stats(ctx context.Context) (stats []TagStats, err error) {
+	// One pass over the events, grouped along the events_by_user_tag
+	// index, aggregates each email and tag. Those are then merged per
+	// username, as several emails may share one, and the latest event with
+	// a value is looked up by its sequence. Emails are left out, so the
+	// stats can be published.
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			g.recordedBy,
+			g.tag,
+			g.count,
+			g.sum,
+			COALESCE(latest.value, ''),
+			COALESCE(latest.recordedAt, '')
+		FROM (
+			SELECT
+				COALESCE(u.username, ?) AS recordedBy,
+				e.tag AS tag,
+				SUM(e.count) AS count,
+				TOTAL(e.sum) AS sum,
+				MAX(e.latestSequence) AS latestSequence
+			FROM (
+				SELECT
+					recordedBy,
+					tag,
+					COUNT(*) AS count,
+					TOTAL(CASE WHEN value != '' THEN CAST(value AS REAL) END) AS sum,
+					MAX(CASE WHEN value != '' THEN sequence END) AS latestSequence
+				FROM events
+				GROUP BY recordedBy, tag
+			) e
+			LEFT JOIN (
+				SELECT email, MIN(username) AS username FROM users GROUP BY email
+			) u ON e.recordedBy = u.email
+			GROUP BY 1, 2
+		) g
+		LEFT JOIN events latest ON latest.sequence = g.latestSequence
+		ORDER BY g.recordedBy, g.tag;
+	`, UnknownUser)
+	if err != nil {
 		return nil, err
 	}
 
-	return events, err
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	for rows.Next() {
+		var t TagStats
+		if err := rows.Scan(&t.RecordedBy, &t.Tag, &t.Count, &t.Sum, &t.Latest, &t.LatestAt); err != nil {
+			return nil, err
+		}
+		stats = append(stats, t)
+	}
+	return stats, rows.Err()
+}
+
+func (f Filter) where() (string, []any) {
+	var clauses []string
+	var args []any
+
+	if f.Tag != "" {
+		clauses = append(clauses, "e.tag = ?")
+		args = append(args, f.Tag)
+	}
+	if f.RecordedBy != "" {
+		clauses = append(clauses, "COALESCE(u.username, e.recordedBy) = ?")
+		args = append(args, f.RecordedBy)
+	}
+	if f.From != "" {
+		clauses = append(clauses, "substr(e.recordedAt, 1, 10) >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		clauses = append(clauses, "substr(e.recordedAt, 1, 10) <= ?")
+		args = append(args, f.To)
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(clauses, " AND "), args
 }
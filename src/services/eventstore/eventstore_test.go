@@ -0,0 +1,62 @@
+package eventstore
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+)
+
+func TestStatsPerUsernameAndTag(t *testing.T) {
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	ctx := context.Background()
+
+	for _, user := range [][2]string{
+		{"jane@example.com", "jane"},
+		{"jane@work.example.com", "jane"},
+		{"joe@example.com", "joe"},
+	} {
+		if _, err := db.Exec(`INSERT INTO users (email, username) VALUES (?, ?);`, user[0], user[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewEventStore(db)
+	for _, e := range []Event{
+		{Tag: "run", Value: "5", RecordedAt: "2026-01-01T08:00:00Z", RecordedBy: "jane@example.com"},
+		{Tag: "run", Value: "7", RecordedAt: "2026-01-02T08:00:00Z", RecordedBy: "jane@work.example.com"},
+		{Tag: "run", RecordedAt: "2026-01-03T08:00:00Z", RecordedBy: "jane@example.com"},
+		{Tag: "swim", RecordedAt: "2026-01-01T09:00:00Z", RecordedBy: "joe@example.com"},
+		{Tag: "run", Value: "3", RecordedAt: "2026-01-01T10:00:00Z", RecordedBy: "gone@example.com"},
+	} {
+		if err := s.Record(ctx, e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []TagStats{
+		{RecordedBy: "jane", Tag: "run", Count: 3, Sum: 12, Latest: "7", LatestAt: "2026-01-02T08:00:00Z"},
+		{RecordedBy: "joe", Tag: "swim", Count: 1},
+		{RecordedBy: UnknownUser, Tag: "run", Count: 1, Sum: 3, Latest: "3", LatestAt: "2026-01-01T10:00:00Z"},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+	for _, st := range stats {
+		if strings.Contains(st.RecordedBy, "@") {
+			t.Errorf("stats expose an email: %+v", st)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+)
+
+// AtomFeed holds the feed-level metadata of an Atom export.
+type AtomFeed struct {
+	ID        string // defaults to SelfURL
+	Title     string
+	SelfURL   string
+	AppOrigin string
+}
+
+// Atom returns a format rendering events as an Atom feed. Events are
+// expected newest first, as returned by the event store.
+func Atom(feed AtomFeed) Format {
+	return Format{
+		ContentType: "application/atom+xml; charset=utf-8",
+		Extension:   "atom",
+		NewWriter: func(w io.Writer) (Writer, error) {
+			return &atomWriter{w: w, feed: feed, enc: xml.NewEncoder(w)}, nil
+		},
+	}
+}
+
+func (f AtomFeed) id() string {
+	if f.ID != "" {
+		return f.ID
+	}
+	return f.SelfURL
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	XMLName xml.Name   `xml:"entry"`
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Content *atomText  `xml:"content,omitempty"`
+}
+
+// atomWriter defers writing the feed header until the first entry is
+// known, because the feed's updated timestamp is that of its newest entry.
+type atomWriter struct {
+	w       io.Writer
+	feed    AtomFeed
+	enc     *xml.Encoder
+	started bool
+}
+
+func (a *atomWriter) start(updated time.Time) error {
+	a.started = true
+	if _, err := io.WriteString(a.w, xml.Header+`<feed xmlns="http://www.w3.org/2005/Atom">`); err != nil {
+		return err
+	}
+	elements := []struct {
+		name  string
+		value any
+	}{
+		{"id", a.feed.id()},
+		{"title", a.feed.Title},
+		{"updated", updated.UTC().Format(time.RFC3339)},
+		{"link", atomLink{Rel: "self", Href: a.feed.SelfURL}},
+	}
+	for _, el := range elements {
+		if err := a.enc.EncodeElement(el.value, xml.StartElement{Name: xml.Name{Local: el.name}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *atomWriter) Write(e eventstore.Event) error {
+	updated := eventstore.ParseRecordedAt(e.RecordedAt)
+	if !a.started {
+		if err := a.start(updated); err != nil {
+			return err
+		}
+	}
+
+	entry := atomEntry{
+		ID:      EntryID(a.feed.AppOrigin, e),
+		Title:   entryTitle(e),
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: e.RecordedBy},
+	}
+	if e.Comment != "" {
+		entry.Content = &atomText{Type: "text", Body: e.Comment}
+	}
+	return a.enc.Encode(entry)
+}
+
+func (a *atomWriter) Close() error {
+	if !a.started {
+		if err := a.start(time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := a.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(a.w, "</feed>\n")
+	return err
+}
+
+func entryTitle(e eventstore.Event) string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s: %s", e.RecordedBy, e.Tag)
+	}
+	return fmt.Sprintf("%s: %s %s", e.RecordedBy, e.Tag, e.Value)
+}
+
+// EntryID returns a stable, globally unique identifier for an event.
+func EntryID(appOrigin string, e eventstore.Event) string {
+	return fmt.Sprintf("tag:%s,2026:event:%d", originHost(appOrigin), e.ID)
+}
+
+func originHost(appOrigin string) string {
+	if u, err := url.Parse(appOrigin); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	return appOrigin
+}
@@ -0,0 +1,192 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/xuri/excelize/v2"
+)
+
+// Writer encodes events one at a time. Close must be called once all
+// events have been written to flush any buffered output.
+type Writer interface {
+	Write(event eventstore.Event) error
+	Close() error
+}
+
+// Format describes an export file format.
+type Format struct {
+	ContentType string
+	Extension   string
+	NewWriter   func(w io.Writer) (Writer, error)
+}
+
+var (
+	CSV = Format{
+		ContentType: "text/csv; charset=utf-8",
+		Extension:   "csv",
+		NewWriter:   newCSVWriter,
+	}
+	JSON = Format{
+		ContentType: "application/json",
+		Extension:   "json",
+		NewWriter:   newJSONWriter,
+	}
+	NDJSON = Format{
+		ContentType: "application/x-ndjson",
+		Extension:   "ndjson",
+		NewWriter:   newNDJSONWriter,
+	}
+	XLSX = Format{
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extension:   "xlsx",
+		NewWriter:   newXLSXWriter,
+	}
+)
+
+var header = []string{"id", "tag", "value", "comment", "recordedAt", "recordedBy"}
+
+func record(e eventstore.Event) []string {
+	return []string{
+		strconv.FormatInt(e.ID, 10),
+		e.Tag,
+		e.Value,
+		e.Comment,
+		e.RecordedAt,
+		e.RecordedBy,
+	}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (Writer, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvWriter{w: cw}, nil
+}
+
+func (c *csvWriter) Write(e eventstore.Event) error {
+	return c.w.Write(record(e))
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonWriter writes a single JSON array, one element per event.
+type jsonWriter struct {
+	w     io.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONWriter(w io.Writer) (Writer, error) {
+	return &jsonWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (j *jsonWriter) Write(e eventstore.Event) error {
+	sep := ","
+	if j.count == 0 {
+		sep = "["
+	}
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	j.count++
+	return j.enc.Encode(e)
+}
+
+func (j *jsonWriter) Close() error {
+	if j.count == 0 {
+		_, err := io.WriteString(j.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) (Writer, error) {
+	return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+}
+
+func (n *ndjsonWriter) Write(e eventstore.Event) error {
+	return n.enc.Encode(e)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+// xlsxWriter uses excelize's stream writer, which spills rows to a temp
+// file once they exceed its in-memory buffer. The zip container itself
+// can only be written once all rows are known, so output happens on Close.
+type xlsxWriter struct {
+	out  io.Writer
+	file *excelize.File
+	sw   *excelize.StreamWriter
+	row  int
+}
+
+const xlsxSheet = "Events"
+
+func newXLSXWriter(w io.Writer) (Writer, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName("Sheet1", xlsxSheet); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	sw, err := f.NewStreamWriter(xlsxSheet)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	x := &xlsxWriter{out: w, file: f, sw: sw, row: 1}
+	cells := make([]any, len(header))
+	for i, h := range header {
+		cells[i] = h
+	}
+	if err := x.setRow(cells); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxWriter) Write(e eventstore.Event) error {
+	var value any = e.Value
+	if num, err := strconv.ParseFloat(e.Value, 64); err == nil {
+		value = num
+	}
+	return x.setRow([]any{e.ID, e.Tag, value, e.Comment, e.RecordedAt, e.RecordedBy})
+}
+
+func (x *xlsxWriter) setRow(cells []any) error {
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	x.row++
+	return x.sw.SetRow(cell, cells)
+}
+
+func (x *xlsxWriter) Close() error {
+	defer func() { _ = x.file.Close() }()
+	if err := x.sw.Flush(); err != nil {
+		return fmt.Errorf("flush xlsx rows: %w", err)
+	}
+	return x.file.Write(x.out)
+}
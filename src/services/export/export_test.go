@@ -0,0 +1,119 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/xuri/excelize/v2"
+)
+
+var testEvents = []eventstore.Event{
+	{ID: 2, Tag: "weight", Value: "72.5", Comment: "after run, tired", RecordedAt: "2026-01-02T08:00:00Z", RecordedBy: "alice"},
+	{ID: 1, Tag: "exercise", Comment: "yoga", RecordedAt: "2026-01-01T08:00:00Z", RecordedBy: "bob"},
+}
+
+func writeAll(t *testing.T, format Format) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := format.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, e := range testEvents {
+		if err := w.Write(e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	got := string(writeAll(t, CSV))
+	want := "id,tag,value,comment,recordedAt,recordedBy\n" +
+		"2,weight,72.5,\"after run, tired\",2026-01-02T08:00:00Z,alice\n" +
+		"1,exercise,,yoga,2026-01-01T08:00:00Z,bob\n"
+	if got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(string(writeAll(t, NDJSON))), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	want := `{"id":1,"tag":"exercise","comment":"yoga","value":"","recordedAt":"2026-01-01T08:00:00Z","recordedBy":"bob"}`
+	if lines[1] != want {
+		t.Errorf("expected '%s', got '%s'", want, lines[1])
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	f, err := excelize.OpenReader(bytes.NewReader(writeAll(t, XLSX)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	rows, err := f.GetRows(xlsxSheet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[1][2] != "72.5" || rows[2][3] != "yoga" {
+		t.Errorf("unexpected rows: %v", rows)
+	}
+}
+
+func TestAtom(t *testing.T) {
+	feed := AtomFeed{Title: "Events", SelfURL: "https://example.com/all-events", AppOrigin: "https://example.com"}
+	got := string(writeAll(t, Atom(feed)))
+
+	for _, want := range []string{
+		"<updated>2026-01-02T08:00:00Z</updated>",
+		"<id>tag:example.com,2026:event:2</id>",
+		"<title>alice: weight 72.5</title>",
+		"<title>bob: exercise</title>",
+		`<content type="text">yoga</content>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected feed to contain '%s', got:\n%s", want, got)
+		}
+	}
+}
+
+func TestICal(t *testing.T) {
+	got := string(writeAll(t, ICal(Calendar{Name: "Events", AppOrigin: "https://example.com"})))
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:event-2@example.com\r\n",
+		"DTSTART:20260102T080000Z\r\n",
+		"DURATION:PT0S\r\n",
+		"DESCRIPTION:after run\\, tired\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected calendar to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestICalFoldsLongLines(t *testing.T) {
+	var buf bytes.Buffer
+	c := &icalWriter{w: &buf}
+	c.line("DESCRIPTION:" + strings.Repeat("ä", 100))
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+	}
+}
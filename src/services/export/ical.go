@@ -0,0 +1,105 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+)
+
+// Calendar holds the calendar-level metadata of an iCalendar export.
+type Calendar struct {
+	Name      string
+	AppOrigin string
+}
+
+// ICal returns a format rendering events as an iCalendar (RFC 5545) feed.
+// Events are recorded without an end, so each entry lasts zero seconds
+// from the time it was recorded.
+func ICal(cal Calendar) Format {
+	return Format{
+		ContentType: "text/calendar; charset=utf-8",
+		Extension:   "ics",
+		NewWriter: func(w io.Writer) (Writer, error) {
+			c := &icalWriter{w: w, cal: cal}
+			c.line("BEGIN:VCALENDAR")
+			c.line("VERSION:2.0")
+			c.line("PRODID:-//rechenschaftspflicht//events//EN")
+			c.line("CALSCALE:GREGORIAN")
+			c.line("METHOD:PUBLISH")
+			c.line("X-WR-CALNAME:" + escapeText(cal.Name))
+			return c, c.err
+		},
+	}
+}
+
+type icalWriter struct {
+	w   io.Writer
+	cal Calendar
+	err error
+}
+
+const icalTime = "20060102T150405Z"
+
+func (c *icalWriter) Write(e eventstore.Event) error {
+	start := eventstore.ParseRecordedAt(e.RecordedAt).UTC().Format(icalTime)
+
+	c.line("BEGIN:VEVENT")
+	// UIDs must stay the same across fetches so clients update entries
+	// instead of duplicating them.
+	c.line(fmt.Sprintf("UID:event-%d@%s", e.ID, originHost(c.cal.AppOrigin)))
+	// Events are never edited, so the time of recording doubles as DTSTAMP.
+	c.line("DTSTAMP:" + start)
+	c.line("DTSTART:" + start)
+	c.line("DURATION:PT0S")
+	c.line("SUMMARY:" + escapeText(entryTitle(e)))
+	if e.Comment != "" {
+		c.line("DESCRIPTION:" + escapeText(e.Comment))
+	}
+	c.line("CATEGORIES:" + escapeText(e.Tag))
+	c.line("END:VEVENT")
+	return c.err
+}
+
+func (c *icalWriter) Close() error {
+	c.line("END:VCALENDAR")
+	return c.err
+}
+
+// line writes a content line, folded to at most 75 octets per line as
+// required by RFC 5545. The first write error sticks.
+func (c *icalWriter) line(s string) {
+	if c.err != nil {
+		return
+	}
+	var b strings.Builder
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// continuation lines start with a space, which counts
+		limit = 74
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, c.err = io.WriteString(c.w, b.String())
+}
+
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
@@ -0,0 +1,135 @@
+package feedtokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid feed token")
+
+// FeedToken describes a user's active feed token. The token itself is only
+// known at creation time as just its hash is stored.
+type FeedToken struct {
+	Email     string
+	CreatedAt string
+}
+
+// FeedTokenStore manages the secret tokens that authenticate feed URLs,
+// which feed readers and calendar apps fetch without a session cookie.
+// Each user has at most one active token.
+type FeedTokenStore interface {
+	// Create revokes the user's current token, if any, and returns a new one.
+	Create(email string) (string, error)
+	Active(email string) (FeedToken, bool, error)
+	// Lookup returns the email of the owner of an active token.
+	Lookup(token string) (string, error)
+	Revoke(email string) error
+}
+
+type SQLiteFeedTokenStore struct {
+	db *sql.DB
+}
+
+func NewFeedTokenStore(db *sql.DB) FeedTokenStore {
+	return &SQLiteFeedTokenStore{db: db}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SQLiteFeedTokenStore) Create(email string) (token string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now().Format(time.RFC3339)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	const revoke = `
+		UPDATE feed_tokens
+		SET revokedAt = ?
+		WHERE LOWER(email) = LOWER(?) AND revokedAt IS NULL;
+	`
+	if _, err = tx.Exec(revoke, now, email); err != nil {
+		return "", err
+	}
+
+	const insert = `
+		INSERT INTO feed_tokens (email, tokenHash, createdAt)
+		VALUES (LOWER(?), ?, ?);
+	`
+	if _, err = tx.Exec(insert, email, hashToken(token), now); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *SQLiteFeedTokenStore) Active(email string) (FeedToken, bool, error) {
+	const query = `
+		SELECT email, createdAt
+		FROM feed_tokens
+		WHERE LOWER(email) = LOWER(?) AND revokedAt IS NULL
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+
+	var t FeedToken
+	err := s.db.QueryRow(query, email).Scan(&t.Email, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FeedToken{}, false, nil
+	}
+	if err != nil {
+		return FeedToken{}, false, err
+	}
+	return t, true, nil
+}
+
+func (s *SQLiteFeedTokenStore) Lookup(token string) (string, error) {
+	const query = `
+		SELECT email
+		FROM feed_tokens
+		WHERE tokenHash = ? AND revokedAt IS NULL;
+	`
+
+	var email string
+	err := s.db.QueryRow(query, hashToken(token)).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+func (s *SQLiteFeedTokenStore) Revoke(email string) error {
+	const query = `
+		UPDATE feed_tokens
+		SET revokedAt = ?
+		WHERE LOWER(email) = LOWER(?) AND revokedAt IS NULL;
+	`
+
+	_, err := s.db.Exec(query, time.Now().Format(time.RFC3339), email)
+	return err
+}
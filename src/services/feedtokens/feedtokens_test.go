@@ -0,0 +1,87 @@
+package feedtokens
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+)
+
+func newTestStore(t *testing.T) FeedTokenStore {
+	t.Helper()
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return NewFeedTokenStore(db)
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	s := newTestStore(t)
+
+	if _, active, err := s.Active("user@example.com"); err != nil || active {
+		t.Fatalf("expected no active token, got %v, %v", active, err)
+	}
+
+	token, err := s.Create("User@Example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if owner, err := s.Lookup(token); err != nil || owner != "user@example.com" {
+		t.Errorf("expected token to belong to user@example.com, got %q, %v", owner, err)
+	}
+	if ft, active, err := s.Active("user@example.com"); err != nil || !active || ft.CreatedAt == "" {
+		t.Errorf("expected an active token, got %+v, %v, %v", ft, active, err)
+	}
+	if _, err := s.Lookup("not-a-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v for an unknown token, got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestCreateReplacesPreviousToken(t *testing.T) {
+	s := newTestStore(t)
+
+	old, err := s.Create("user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	theirs, err := s.Create("other@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current, err := s.Create("user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := s.Lookup(old); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v for the replaced token, got %v", ErrInvalidToken, err)
+	}
+	if _, err := s.Lookup(current); err != nil {
+		t.Errorf("expected the new token to work, got %v", err)
+	}
+	if _, err := s.Lookup(theirs); err != nil {
+		t.Errorf("expected another user's token to work, got %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := newTestStore(t)
+
+	token, err := s.Create("user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Revoke("user@example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Lookup(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v for a revoked token, got %v", ErrInvalidToken, err)
+	}
+	if _, active, err := s.Active("user@example.com"); err != nil || active {
+		t.Errorf("expected no active token, got %v, %v", active, err)
+	}
+}
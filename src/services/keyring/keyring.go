@@ -0,0 +1,130 @@
+// Package keyring holds the keys tokens are signed with. One key signs new
+// tokens; the others still verify tokens signed before a rotation until
+// they are removed from the configuration.
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LegacyKeyID is the ID of the key given as JWT_SECRET. Tokens without a
+// kid header, issued before keys had IDs, are verified with it.
+const LegacyKeyID = "default"
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Key is a signing key and the ID tokens refer to it by.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// String formats the key as an entry for JWT_KEYS.
+func (k Key) String() string {
+	return k.ID + ":" + string(k.Secret)
+}
+
+// Parse reads an "id:secret" entry.
+func Parse(entry string) (Key, error) {
+	id, secret, ok := strings.Cut(entry, ":")
+	if !ok || secret == "" {
+		return Key{}, errors.New("key must be given as id:secret")
+	}
+	if !validID.MatchString(id) {
+		return Key{}, fmt.Errorf("key ID %q may only contain letters, digits, '.', '_' and '-'", id)
+	}
+	return Key{ID: id, Secret: []byte(secret)}, nil
+}
+
+// Generate returns a new random key, with an ID starting with today's date
+// so keys sort by age.
+func Generate() (Key, error) {
+	suffix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(suffix); err != nil {
+		return Key{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{
+		ID:     time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(suffix),
+		Secret: []byte(hex.EncodeToString(secret)),
+	}, nil
+}
+
+type Keyring struct {
+	active Key
+	keys   map[string]Key
+	ids    []string
+}
+
+// New builds a keyring from "id:secret" entries and, if set, the legacy
+// single secret. The key with ID active signs new tokens; without it the
+// first entry does, or the legacy secret if there are no entries.
+func New(entries []string, active, legacySecret string) (*Keyring, error) {
+	k := &Keyring{keys: map[string]Key{}}
+	add := func(key Key) error {
+		if _, exists := k.keys[key.ID]; exists {
+			return fmt.Errorf("key ID %q is used twice", key.ID)
+		}
+		k.keys[key.ID] = key
+		k.ids = append(k.ids, key.ID)
+		return nil
+	}
+
+	for _, entry := range entries {
+		key, err := Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	if legacySecret != "" {
+		if err := add(Key{ID: LegacyKeyID, Secret: []byte(legacySecret)}); err != nil {
+			return nil, err
+		}
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	if active == "" {
+		active = k.ids[0]
+	}
+	key, ok := k.keys[active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", active)
+	}
+	k.active = key
+	return k, nil
+}
+
+// Active returns the key new tokens are signed with.
+func (k *Keyring) Active() Key {
+	return k.active
+}
+
+// Lookup returns the key with the given ID. An empty ID stands for the
+// legacy key.
+func (k *Keyring) Lookup(id string) (Key, bool) {
+	if id == "" {
+		id = LegacyKeyID
+	}
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// IDs returns the key IDs in configuration order.
+func (k *Keyring) IDs() []string {
+	return slices.Clone(k.ids)
+}
@@ -0,0 +1,72 @@
+package keyring
+
+import (
+	"testing"
+)
+
+func TestNewPicksActiveKey(t *testing.T) {
+	k, err := New([]string{"new:s2", "old:s1"}, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k.Active().ID != "new" {
+		t.Errorf("expected first entry to be active, got %q", k.Active().ID)
+	}
+
+	k, err = New([]string{"new:s2", "old:s1"}, "old", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k.Active().ID != "old" {
+		t.Errorf("expected configured key to be active, got %q", k.Active().ID)
+	}
+	if _, ok := k.Lookup("new"); !ok {
+		t.Error("expected inactive key to remain available for verification")
+	}
+}
+
+func TestNewWithLegacySecret(t *testing.T) {
+	k, err := New(nil, "", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k.Active().ID != LegacyKeyID {
+		t.Errorf("expected legacy key to be active, got %q", k.Active().ID)
+	}
+	if key, ok := k.Lookup(""); !ok || string(key.Secret) != "secret" {
+		t.Error("expected tokens without kid to use the legacy key")
+	}
+}
+
+func TestNewRejectsBadKeyrings(t *testing.T) {
+	cases := map[string]struct {
+		entries []string
+		active  string
+	}{
+		"empty":          {nil, ""},
+		"missing secret": {[]string{"a:"}, ""},
+		"no separator":   {[]string{"secret"}, ""},
+		"bad id":         {[]string{"a b:secret"}, ""},
+		"duplicate id":   {[]string{"a:s1", "a:s2"}, ""},
+		"unknown active": {[]string{"a:s1"}, "b"},
+	}
+	for name, c := range cases {
+		if _, err := New(c.entries, c.active, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestGeneratedKeyParses(t *testing.T) {
+	key, err := Generate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := Parse(key.String())
+	if err != nil {
+		t.Fatalf("generated key does not parse: %v", err)
+	}
+	if parsed.ID != key.ID || string(parsed.Secret) != string(key.Secret) {
+		t.Errorf("expected %v, got %v", key, parsed)
+	}
+}
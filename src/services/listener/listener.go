@@ -0,0 +1,132 @@
+// Package listener opens the socket the server accepts connections on.
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Listen opens a listener for addr, which is one of
+//
+//   - host:port, e.g. ":8080" or "127.0.0.1:8080", for TCP,
+//   - unix:/path/to/socket for a unix domain socket, created with the
+//     octal permissions in socketMode (e.g. "0660") when non-empty,
+//   - systemd or systemd:name for a socket passed in by systemd socket
+//     activation, optionally selected by its FileDescriptorName.
+func Listen(addr, socketMode string, getenv func(string) string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"), socketMode)
+	case addr == "systemd":
+		return listenSystemd("", getenv)
+	case strings.HasPrefix(addr, "systemd:"):
+		return listenSystemd(strings.TrimPrefix(addr, "systemd:"), getenv)
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+func listenUnix(path, socketMode string) (net.Listener, error) {
+	// A socket left behind by an unclean shutdown would make Listen fail,
+	// but only remove it if it is a socket and nothing answers on it.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket: %w", err)
+		}
+	}
+
+	if socketMode == "" {
+		return net.Listen("unix", path)
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", socketMode, err)
+	}
+	// The socket takes its permissions from the umask when it is bound.
+	// Chmod it in a directory only we can enter and move it into place,
+	// so it is never reachable with wider permissions.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".listen-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create socket: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would remove tmp on Close rather than the socket at path.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, os.FileMode(mode)); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("could not set socket mode: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("could not move socket into place: %w", err)
+	}
+	return &movedUnixListener{UnixListener: l, path: path}, nil
+}
+
+// movedUnixListener removes its socket on Close from where it was moved to
+// after being bound.
+type movedUnixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *movedUnixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// listenSystemd picks up a socket passed according to sd_listen_fds(3).
+// With an empty name the first socket is used.
+func listenSystemd(name string, getenv func(string) string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd: LISTEN_PID is not set to this process")
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd: LISTEN_FDS is not set")
+	}
+
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	for i := range n {
+		fdName := ""
+		if i < len(names) {
+			fdName = names[i]
+		}
+		if name != "" && fdName != name {
+			continue
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), fdName)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor, so ours is no longer needed.
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %w", listenFDsStart+i, err)
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
@@ -0,0 +1,66 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSetsMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0o600, 0o666} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "app.sock")
+
+		l, err := Listen("unix:"+path, fmt.Sprintf("%o", mode), func(string) string { return "" })
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("socket not created: %v", err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			t.Errorf("expected mode %o, got %o", mode, got)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("expected only the socket in %s, got %v", dir, entries)
+		}
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("could not connect to socket: %v", err)
+		}
+		_ = conn.Close()
+
+		if err := l.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected socket to be removed on close, got %v", err)
+		}
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Listen("unix:"+path, "", func(string) string { return "" }); err == nil {
+		t.Error("expected error for a path that is not a socket")
+	}
+}
+
+func TestListenSystemdRequiresMatchingPID(t *testing.T) {
+	getenv := func(key string) string {
+		return map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}[key]
+	}
+
+	if _, err := Listen("systemd", "", getenv); err == nil {
+		t.Error("expected error when sockets were passed to another process")
+	}
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// New creates the application's logger. level is one of debug, info, warn
+// or error and format is either json or text. Emails and tokens are
+// redacted from all attributes. Empty values select info and json.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+type loggerCtxKey struct{}
+
+// WithLogger returns a context carrying logger, to be retrieved with
+// FromContext further down the call chain.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger, falling back to the
+// default logger outside of requests.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds attributes to the logger carried by ctx.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+var sensitiveKeys = map[string]bool{
+	"token":         true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"password":      true,
+	"secret":        true,
+}
+
+var (
+	emailPattern      = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+	tokenParamPattern = regexp.MustCompile(`((?:^|[?&])token=)[^&\s"]+`)
+	feedTokenPattern  = regexp.MustCompile(`(/feed/)[^/\s"?]+`)
+)
+
+// Redact masks email addresses and tokens in URLs within s.
+func Redact(s string) string {
+	s = emailPattern.ReplaceAllString(s, "$1***@$2")
+	s = tokenParamPattern.ReplaceAllString(s, "${1}REDACTED")
+	s = feedTokenPattern.ReplaceAllString(s, "${1}REDACTED")
+	return s
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "REDACTED")
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := map[string]string{
+		"alice@example.com":                 "a***@example.com",
+		"/login?token=abc.def.ghi":          "/login?token=REDACTED",
+		"/all-events?tag=x&token=abc":       "/all-events?tag=x&token=REDACTED",
+		"/feed/0123abcd/events.ics":         "/feed/REDACTED/events.ics",
+		"could not send to bob@example.org": "could not send to b***@example.org",
+		"nothing to see here":               "nothing to see here",
+	}
+	for in, want := range tests {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewRedactsAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logger.Info("login",
+		"email", "alice@example.com",
+		"token", "secret-token",
+		"error", errors.New("smtp rejected alice@example.com"),
+	)
+
+	out := buf.String()
+	for _, leak := range []string{"alice@example.com", "secret-token"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log output contains %q: %s", leak, out)
+		}
+	}
+	if !strings.Contains(out, `"email":"a***@example.com"`) {
+		t.Errorf("expected masked email in output: %s", out)
+	}
+}
+
+func TestNewRejectsUnknownLevel(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "verbose", "json"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
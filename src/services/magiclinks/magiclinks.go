@@ -0,0 +1,228 @@
+package magiclinks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// MaxCodeAttempts is how often a link's code may be entered before it is
+// locked, which keeps guessing six digits hopeless.
+const MaxCodeAttempts = 5
+
+var (
+	// ErrAlreadyUsed means the link was consumed before, i.e. someone is
+	// replaying it.
+	ErrAlreadyUsed = errors.New("magic link already used")
+	// ErrInvalidLink means the link was never issued, has expired or was
+	// superseded by a newer one.
+	ErrInvalidLink = errors.New("magic link invalid")
+	// ErrWrongCode means the code entered doesn't match the link's.
+	ErrWrongCode = errors.New("login code wrong")
+	// ErrTooManyAttempts means the link's code was entered wrongly too
+	// often. The link itself may still be clicked.
+	ErrTooManyAttempts = errors.New("too many login code attempts")
+)
+
+// Link is an issued magic link. Code is the one-time code sent along with
+// it, for logging in without opening the link on the same device.
+type Link struct {
+	ID        string
+	Email     string
+	Code      string
+	Remember  bool
+	ExpiresAt time.Time
+}
+
+// MagicLinkStore is the ledger of issued magic links that makes each link
+// usable only once. Links are identified by the ID (jti) of their token.
+type MagicLinkStore interface {
+	// Issue records a new link. With invalidateOlder, the email's
+	// outstanding links can no longer be used.
+	Issue(ctx context.Context, link Link, invalidateOlder bool) error
+	// Consume marks the link as used, failing with ErrAlreadyUsed or
+	// ErrInvalidLink if it can't be used.
+	Consume(ctx context.Context, id string) error
+	// ConsumeCode uses the link by its code instead, failing with
+	// ErrWrongCode or ErrTooManyAttempts in addition to Consume's errors.
+	// The returned link has no code.
+	ConsumeCode(ctx context.Context, id, code string) (Link, error)
+	// Outstanding counts the email's links that can still be used.
+	Outstanding(ctx context.Context, email string) (int, error)
+}
+
+type SQLiteMagicLinkStore struct {
+	db *sql.DB
+}
+
+func NewMagicLinkStore(db *sql.DB) MagicLinkStore {
+	return &SQLiteMagicLinkStore{db: db}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// NewCode returns a random six digit code.
+func NewCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashCode salts the code with the link ID, so equal codes of different
+// links don't hash alike.
+func hashCode(id, code string) string {
+	sum := sha256.Sum256([]byte(id + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SQLiteMagicLinkStore) Issue(ctx context.Context, link Link, invalidateOlder bool) (err error) {
+	now := timestamp(time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// Expired links are useless to keep around.
+	const prune = `DELETE FROM magic_links WHERE expiresAt < ?;`
+	if _, err = tx.ExecContext(ctx, prune, now); err != nil {
+		return err
+	}
+	const pruneCodes = `DELETE FROM login_codes WHERE linkId NOT IN (SELECT id FROM magic_links);`
+	if _, err = tx.ExecContext(ctx, pruneCodes); err != nil {
+		return err
+	}
+
+	if invalidateOlder {
+		const revoke = `
+			UPDATE magic_links
+			SET revokedAt = ?
+			WHERE LOWER(email) = LOWER(?) AND consumedAt IS NULL AND revokedAt IS NULL;
+		`
+		if _, err = tx.ExecContext(ctx, revoke, now, link.Email); err != nil {
+			return err
+		}
+	}
+
+	const insert = `
+		INSERT INTO magic_links (id, email, createdAt, expiresAt)
+		VALUES (?, LOWER(?), ?, ?);
+	`
+	if _, err = tx.ExecContext(ctx, insert, link.ID, link.Email, now, timestamp(link.ExpiresAt)); err != nil {
+		return err
+	}
+
+	if link.Code != "" {
+		const insertCode = `
+			INSERT INTO login_codes (linkId, codeHash, remember, attempts)
+			VALUES (?, ?, ?, 0);
+		`
+		if _, err = tx.ExecContext(ctx, insertCode, link.ID, hashCode(link.ID, link.Code), link.Remember); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteMagicLinkStore) Consume(ctx context.Context, id string) error {
+	now := timestamp(time.Now())
+
+	// A single conditional update, so concurrent requests with the same
+	// link can't both succeed.
+	const consume = `
+		UPDATE magic_links
+		SET consumedAt = ?
+		WHERE id = ? AND consumedAt IS NULL AND revokedAt IS NULL AND expiresAt >= ?;
+	`
+	res, err := s.db.ExecContext(ctx, consume, now, id, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 1 {
+		return nil
+	}
+
+	var consumedAt sql.NullString
+	err = s.db.QueryRowContext(ctx, `SELECT consumedAt FROM magic_links WHERE id = ?;`, id).Scan(&consumedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidLink
+	}
+	if err != nil {
+		return err
+	}
+	if consumedAt.Valid {
+		return ErrAlreadyUsed
+	}
+	return ErrInvalidLink
+}
+
+func (s *SQLiteMagicLinkStore) ConsumeCode(ctx context.Context, id, code string) (Link, error) {
+	const selectCode = `
+		SELECT l.email, c.codeHash, c.remember, l.expiresAt
+		FROM login_codes c JOIN magic_links l ON l.id = c.linkId
+		WHERE c.linkId = ?;
+	`
+	link := Link{ID: id}
+	var codeHash, expiresAt string
+	err := s.db.QueryRowContext(ctx, selectCode, id).Scan(&link.Email, &codeHash, &link.Remember, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Link{}, ErrInvalidLink
+	}
+	if err != nil {
+		return Link{}, err
+	}
+	link.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+
+	// Count the attempt before checking it, so concurrent guesses can't
+	// exceed the limit.
+	const attempt = `
+		UPDATE login_codes
+		SET attempts = attempts + 1
+		WHERE linkId = ? AND attempts < ?;
+	`
+	res, err := s.db.ExecContext(ctx, attempt, id, MaxCodeAttempts)
+	if err != nil {
+		return Link{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Link{}, err
+	} else if n == 0 {
+		return Link{}, ErrTooManyAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashCode(id, code)), []byte(codeHash)) != 1 {
+		return Link{}, ErrWrongCode
+	}
+	if err := s.Consume(ctx, id); err != nil {
+		return Link{}, err
+	}
+	return link, nil
+}
+
+func (s *SQLiteMagicLinkStore) Outstanding(ctx context.Context, email string) (int, error) {
+	const count = `
+		SELECT COUNT(*) FROM magic_links
+		WHERE LOWER(email) = LOWER(?) AND consumedAt IS NULL AND revokedAt IS NULL AND expiresAt >= ?;
+	`
+	var n int
+	err := s.db.QueryRowContext(ctx, count, email, timestamp(time.Now())).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,173 @@
+package magiclinks
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+)
+
+const email = "user@example.com"
+
+func newTestStore(t *testing.T) *SQLiteMagicLinkStore {
+	t.Helper()
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &SQLiteMagicLinkStore{db: db}
+}
+
+func issue(t *testing.T, s *SQLiteMagicLinkStore, link Link, invalidateOlder bool) {
+	t.Helper()
+	if link.Email == "" {
+		link.Email = email
+	}
+	if link.ExpiresAt.IsZero() {
+		link.ExpiresAt = time.Now().Add(15 * time.Minute)
+	}
+	if err := s.Issue(context.Background(), link, invalidateOlder); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConsumeOnlyOnce(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "link-1"}, false)
+
+	if err := s.Consume(ctx, "link-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Consume(ctx, "link-1"); !errors.Is(err, ErrAlreadyUsed) {
+		t.Errorf("expected %v for a reused link, got %v", ErrAlreadyUsed, err)
+	}
+	if err := s.Consume(ctx, "never-issued"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("expected %v for an unknown link, got %v", ErrInvalidLink, err)
+	}
+}
+
+func TestIssueInvalidatesOlderLinks(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "old"}, false)
+	issue(t, s, Link{ID: "other", Email: "other@example.com"}, false)
+	issue(t, s, Link{ID: "kept"}, false)
+
+	if n, err := s.Outstanding(ctx, email); err != nil || n != 2 {
+		t.Fatalf("expected 2 outstanding links, got %d, %v", n, err)
+	}
+
+	issue(t, s, Link{ID: "new", Email: "User@Example.com"}, true)
+	for _, id := range []string{"old", "kept"} {
+		if err := s.Consume(ctx, id); !errors.Is(err, ErrInvalidLink) {
+			t.Errorf("expected %v for superseded link %s, got %v", ErrInvalidLink, id, err)
+		}
+	}
+	if n, err := s.Outstanding(ctx, email); err != nil || n != 1 {
+		t.Errorf("expected 1 outstanding link, got %d, %v", n, err)
+	}
+	if err := s.Consume(ctx, "other"); err != nil {
+		t.Errorf("expected another user's link to stay valid, got %v", err)
+	}
+	if err := s.Consume(ctx, "new"); err != nil {
+		t.Errorf("expected the new link to be valid, got %v", err)
+	}
+}
+
+func TestExpiredLinksAreRejectedAndPruned(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "expired", Code: "123456", ExpiresAt: time.Now().Add(-time.Minute)}, false)
+
+	if err := s.Consume(ctx, "expired"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("expected %v for an expired link, got %v", ErrInvalidLink, err)
+	}
+	if n, err := s.Outstanding(ctx, email); err != nil || n != 0 {
+		t.Errorf("expected no outstanding links, got %d, %v", n, err)
+	}
+
+	issue(t, s, Link{ID: "fresh"}, false)
+	var links, codes int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM magic_links;`).Scan(&links); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM login_codes;`).Scan(&codes); err != nil {
+		t.Fatal(err)
+	}
+	if links != 1 || codes != 0 {
+		t.Errorf("expected the expired link and its code to be pruned, got %d links and %d codes", links, codes)
+	}
+}
+
+func TestConsumeCode(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "link-1", Code: "123456", Remember: true}, false)
+
+	if _, err := s.ConsumeCode(ctx, "link-1", "654321"); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("expected %v, got %v", ErrWrongCode, err)
+	}
+	link, err := s.ConsumeCode(ctx, "link-1", "123456")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link.ID != "link-1" || link.Email != email || !link.Remember || link.Code != "" {
+		t.Errorf("unexpected link %+v", link)
+	}
+	if _, err := s.ConsumeCode(ctx, "link-1", "123456"); !errors.Is(err, ErrAlreadyUsed) {
+		t.Errorf("expected %v for a reused code, got %v", ErrAlreadyUsed, err)
+	}
+}
+
+func TestConsumeCodeOnlyForItsLink(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "mine", Code: "111111"}, false)
+	issue(t, s, Link{ID: "theirs", Email: "other@example.com", Code: "222222"}, false)
+
+	if _, err := s.ConsumeCode(ctx, "mine", "222222"); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("expected %v for another link's code, got %v", ErrWrongCode, err)
+	}
+	if _, err := s.ConsumeCode(ctx, "unknown", "111111"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("expected %v for an unknown link, got %v", ErrInvalidLink, err)
+	}
+}
+
+func TestConsumeCodeLocksAfterTooManyAttempts(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "link-1", Code: "123456"}, false)
+
+	for range MaxCodeAttempts {
+		if _, err := s.ConsumeCode(ctx, "link-1", "000000"); !errors.Is(err, ErrWrongCode) {
+			t.Fatalf("expected %v, got %v", ErrWrongCode, err)
+		}
+	}
+	if _, err := s.ConsumeCode(ctx, "link-1", "123456"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("expected %v for the right code after the limit, got %v", ErrTooManyAttempts, err)
+	}
+
+	// The link itself still works.
+	if err := s.Consume(ctx, "link-1"); err != nil {
+		t.Errorf("expected the link to stay usable, got %v", err)
+	}
+}
+
+func TestConsumeCodeAfterLinkWasClicked(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	issue(t, s, Link{ID: "link-1", Code: "123456"}, false)
+
+	if err := s.Consume(ctx, "link-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.ConsumeCode(ctx, "link-1", "123456"); !errors.Is(err, ErrAlreadyUsed) {
+		t.Errorf("expected %v, got %v", ErrAlreadyUsed, err)
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsDesc = prometheus.NewDesc(
+		"rechenschaftspflicht_events_total",
+		"Number of events recorded per user and tag.",
+		[]string{"user", "tag"}, nil,
+	)
+	valueSumDesc = prometheus.NewDesc(
+		"rechenschaftspflicht_event_values_summed",
+		"Sum of the values of all events per user and tag.",
+		[]string{"user", "tag"}, nil,
+	)
+	latestValueDesc = prometheus.NewDesc(
+		"rechenschaftspflicht_event_value_latest",
+		"Value of the most recent event with a value per user and tag.",
+		[]string{"user", "tag"}, nil,
+	)
+	latestTimestampDesc = prometheus.NewDesc(
+		"rechenschaftspflicht_event_value_latest_timestamp_seconds",
+		"Time the most recent event with a value was recorded per user and tag.",
+		[]string{"user", "tag"}, nil,
+	)
+)
+
+// eventsCollector exposes aggregated event values, queried from the event
+// store on every scrape.
+type eventsCollector struct {
+	eventStore eventstore.EventStore
+}
+
+func NewEventsCollector(eventStore eventstore.EventStore) prometheus.Collector {
+	return &eventsCollector{eventStore: eventStore}
+}
+
+func (c *eventsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventsDesc
+	ch <- valueSumDesc
+	ch <- latestValueDesc
+	ch <- latestTimestampDesc
+}
+
+func (c *eventsCollector) Collect(ch chan<- prometheus.Metric) {
+	// Collectors get no request context, so the query runs detached from
+	// the scrape's trace.
+	stats, err := c.eventStore.Stats(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(eventsDesc, err)
+		return
+	}
+
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(s.Count), s.RecordedBy, s.Tag)
+		ch <- prometheus.MustNewConstMetric(valueSumDesc, prometheus.GaugeValue, s.Sum, s.RecordedBy, s.Tag)
+
+		latest, err := strconv.ParseFloat(s.Latest, 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(latestValueDesc, prometheus.GaugeValue, latest, s.RecordedBy, s.Tag)
+		recordedAt := eventstore.ParseRecordedAt(s.LatestAt)
+		if !recordedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(latestTimestampDesc, prometheus.GaugeValue, float64(recordedAt.Unix()), s.RecordedBy, s.Tag)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventsCollector(t *testing.T) {
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, user := range [][2]string{{"jane@example.com", "jane"}, {"joe@example.com", "joe"}} {
+		if _, err := db.Exec(`INSERT INTO users (email, username) VALUES (?, ?);`, user[0], user[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventStore := eventstore.NewEventStore(db)
+	for _, e := range []eventstore.Event{
+		{Tag: "run", Value: "5", RecordedAt: "2026-01-01T08:00:00Z", RecordedBy: "jane@example.com"},
+		{Tag: "run", Value: "7", RecordedAt: "2026-01-02T08:00:00Z", RecordedBy: "jane@example.com"},
+		{Tag: "run", RecordedAt: "2026-01-03T08:00:00Z", RecordedBy: "jane@example.com"},
+		{Tag: "swim", RecordedAt: "2026-01-01T09:00:00Z", RecordedBy: "joe@example.com"},
+	} {
+		if err := eventStore.Record(context.Background(), e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	collector := NewEventsCollector(eventStore)
+
+	want := `
+# HELP rechenschaftspflicht_event_value_latest Value of the most recent event with a value per user and tag.
+# TYPE rechenschaftspflicht_event_value_latest gauge
+rechenschaftspflicht_event_value_latest{tag="run",user="jane"} 7
+# HELP rechenschaftspflicht_event_value_latest_timestamp_seconds Time the most recent event with a value was recorded per user and tag.
+# TYPE rechenschaftspflicht_event_value_latest_timestamp_seconds gauge
+rechenschaftspflicht_event_value_latest_timestamp_seconds{tag="run",user="jane"} 1.7673408e+09
+# HELP rechenschaftspflicht_event_values_summed Sum of the values of all events per user and tag.
+# TYPE rechenschaftspflicht_event_values_summed gauge
+rechenschaftspflicht_event_values_summed{tag="run",user="jane"} 12
+rechenschaftspflicht_event_values_summed{tag="swim",user="joe"} 0
+# HELP rechenschaftspflicht_events_total Number of events recorded per user and tag.
+# TYPE rechenschaftspflicht_events_total counter
+rechenschaftspflicht_events_total{tag="run",user="jane"} 3
+rechenschaftspflicht_events_total{tag="swim",user="joe"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,323 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/apitokens"
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/feedtokens"
+	"github.com/erkannt/rechenschaftspflicht/services/magiclinks"
+	"github.com/erkannt/rechenschaftspflicht/services/passkeys"
+	"github.com/erkannt/rechenschaftspflicht/services/sessions"
+	"github.com/erkannt/rechenschaftspflicht/services/twofactor"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// The decorators below time every store call and count outgoing emails
+// without the services themselves knowing about metrics.
+
+type instrumentedEventStore struct {
+	eventstore.EventStore
+	m *Metrics
+}
+
+func InstrumentEventStore(store eventstore.EventStore, m *Metrics) eventstore.EventStore {
+	return &instrumentedEventStore{EventStore: store, m: m}
+}
+
+func (s *instrumentedEventStore) Record(ctx context.Context, event eventstore.Event) error {
+	defer s.m.ObserveQuery("events", "record")()
+	return s.EventStore.Record(ctx, event)
+}
+
+func (s *instrumentedEventStore) GetAll(ctx context.Context) ([]eventstore.Event, error) {
+	defer s.m.ObserveQuery("events", "get_all")()
+	return s.EventStore.GetAll(ctx)
+}
+
+func (s *instrumentedEventStore) Find(ctx context.Context, filter eventstore.Filter) ([]eventstore.Event, error) {
+	defer s.m.ObserveQuery("events", "find")()
+	return s.EventStore.Find(ctx, filter)
+}
+
+// Each includes the time spent in fn, which for exports is dominated by
+// writing to the client.
+func (s *instrumentedEventStore) Each(ctx context.Context, filter eventstore.Filter, fn func(eventstore.Event) error) error {
+	defer s.m.ObserveQuery("events", "each")()
+	return s.EventStore.Each(ctx, filter, fn)
+}
+
+func (s *instrumentedEventStore) Stats(ctx context.Context) ([]eventstore.TagStats, error) {
+	defer s.m.ObserveQuery("events", "stats")()
+	return s.EventStore.Stats(ctx)
+}
+
+type instrumentedUserStore struct {
+	userstore.UserStore
+	m *Metrics
+}
+
+func InstrumentUserStore(store userstore.UserStore, m *Metrics) userstore.UserStore {
+	return &instrumentedUserStore{UserStore: store, m: m}
+}
+
+func (s *instrumentedUserStore) IsUser(ctx context.Context, email string) (bool, error) {
+	defer s.m.ObserveQuery("users", "is_user")()
+	return s.UserStore.IsUser(ctx, email)
+}
+
+func (s *instrumentedUserStore) AddUser(ctx context.Context, email string, username string) error {
+	defer s.m.ObserveQuery("users", "add_user")()
+	return s.UserStore.AddUser(ctx, email, username)
+}
+
+func (s *instrumentedUserStore) Roles(ctx context.Context, email string) ([]string, error) {
+	defer s.m.ObserveQuery("users", "roles")()
+	return s.UserStore.Roles(ctx, email)
+}
+
+func (s *instrumentedUserStore) SetRoles(ctx context.Context, email string, roles []string) error {
+	defer s.m.ObserveQuery("users", "set_roles")()
+	return s.UserStore.SetRoles(ctx, email, roles)
+}
+
+type instrumentedAuth struct {
+	authentication.Auth
+	m *Metrics
+}
+
+func InstrumentAuth(auth authentication.Auth, m *Metrics) authentication.Auth {
+	return &instrumentedAuth{Auth: auth, m: m}
+}
+
+func (a *instrumentedAuth) SendMagicLink(ctx context.Context, toEmail, token, code string) error {
+	err := a.Auth.SendMagicLink(ctx, toEmail, token, code)
+	if err != nil {
+		a.m.EmailsSent.WithLabelValues("failed").Inc()
+	} else {
+		a.m.EmailsSent.WithLabelValues("sent").Inc()
+	}
+	return err
+}
+
+type instrumentedMagicLinkStore struct {
+	magiclinks.MagicLinkStore
+	m *Metrics
+}
+
+func InstrumentMagicLinkStore(store magiclinks.MagicLinkStore, m *Metrics) magiclinks.MagicLinkStore {
+	return &instrumentedMagicLinkStore{MagicLinkStore: store, m: m}
+}
+
+func (s *instrumentedMagicLinkStore) Issue(ctx context.Context, link magiclinks.Link, invalidateOlder bool) error {
+	defer s.m.ObserveQuery("magic_links", "issue")()
+	return s.MagicLinkStore.Issue(ctx, link, invalidateOlder)
+}
+
+func (s *instrumentedMagicLinkStore) Consume(ctx context.Context, id string) error {
+	defer s.m.ObserveQuery("magic_links", "consume")()
+	return s.MagicLinkStore.Consume(ctx, id)
+}
+
+func (s *instrumentedMagicLinkStore) ConsumeCode(ctx context.Context, id, code string) (magiclinks.Link, error) {
+	defer s.m.ObserveQuery("magic_links", "consume_code")()
+	return s.MagicLinkStore.ConsumeCode(ctx, id, code)
+}
+
+func (s *instrumentedMagicLinkStore) Outstanding(ctx context.Context, email string) (int, error) {
+	defer s.m.ObserveQuery("magic_links", "outstanding")()
+	return s.MagicLinkStore.Outstanding(ctx, email)
+}
+
+type instrumentedSessionStore struct {
+	sessions.SessionStore
+	m *Metrics
+}
+
+func InstrumentSessionStore(store sessions.SessionStore, m *Metrics) sessions.SessionStore {
+	return &instrumentedSessionStore{SessionStore: store, m: m}
+}
+
+func (s *instrumentedSessionStore) Create(ctx context.Context, session sessions.Session) error {
+	defer s.m.ObserveQuery("sessions", "create")()
+	return s.SessionStore.Create(ctx, session)
+}
+
+func (s *instrumentedSessionStore) Get(ctx context.Context, id string) (sessions.Session, error) {
+	defer s.m.ObserveQuery("sessions", "get")()
+	return s.SessionStore.Get(ctx, id)
+}
+
+func (s *instrumentedSessionStore) Touch(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error {
+	defer s.m.ObserveQuery("sessions", "touch")()
+	return s.SessionStore.Touch(ctx, id, lastSeenAt, expiresAt)
+}
+
+func (s *instrumentedSessionStore) Active(ctx context.Context, email string) ([]sessions.Session, error) {
+	defer s.m.ObserveQuery("sessions", "active")()
+	return s.SessionStore.Active(ctx, email)
+}
+
+func (s *instrumentedSessionStore) Revoke(ctx context.Context, email, id string) error {
+	defer s.m.ObserveQuery("sessions", "revoke")()
+	return s.SessionStore.Revoke(ctx, email, id)
+}
+
+func (s *instrumentedSessionStore) RevokeAll(ctx context.Context, email string) error {
+	defer s.m.ObserveQuery("sessions", "revoke_all")()
+	return s.SessionStore.RevokeAll(ctx, email)
+}
+
+type instrumentedPasskeyStore struct {
+	passkeys.PasskeyStore
+	m *Metrics
+}
+
+func InstrumentPasskeyStore(store passkeys.PasskeyStore, m *Metrics) passkeys.PasskeyStore {
+	return &instrumentedPasskeyStore{PasskeyStore: store, m: m}
+}
+
+func (s *instrumentedPasskeyStore) Handle(ctx context.Context, email string) ([]byte, error) {
+	defer s.m.ObserveQuery("passkeys", "handle")()
+	return s.PasskeyStore.Handle(ctx, email)
+}
+
+func (s *instrumentedPasskeyStore) Owner(ctx context.Context, handle []byte) (string, error) {
+	defer s.m.ObserveQuery("passkeys", "owner")()
+	return s.PasskeyStore.Owner(ctx, handle)
+}
+
+func (s *instrumentedPasskeyStore) Add(ctx context.Context, email string, passkey passkeys.Passkey) error {
+	defer s.m.ObserveQuery("passkeys", "add")()
+	return s.PasskeyStore.Add(ctx, email, passkey)
+}
+
+func (s *instrumentedPasskeyStore) List(ctx context.Context, email string) ([]passkeys.Passkey, error) {
+	defer s.m.ObserveQuery("passkeys", "list")()
+	return s.PasskeyStore.List(ctx, email)
+}
+
+func (s *instrumentedPasskeyStore) Used(ctx context.Context, email string, credential webauthn.Credential) error {
+	defer s.m.ObserveQuery("passkeys", "used")()
+	return s.PasskeyStore.Used(ctx, email, credential)
+}
+
+func (s *instrumentedPasskeyStore) Remove(ctx context.Context, email string, credentialID []byte) error {
+	defer s.m.ObserveQuery("passkeys", "remove")()
+	return s.PasskeyStore.Remove(ctx, email, credentialID)
+}
+
+func (s *instrumentedPasskeyStore) SaveCeremony(ctx context.Context, id string, data webauthn.SessionData, expiresAt time.Time) error {
+	defer s.m.ObserveQuery("passkeys", "save_ceremony")()
+	return s.PasskeyStore.SaveCeremony(ctx, id, data, expiresAt)
+}
+
+func (s *instrumentedPasskeyStore) TakeCeremony(ctx context.Context, id string) (webauthn.SessionData, error) {
+	defer s.m.ObserveQuery("passkeys", "take_ceremony")()
+	return s.PasskeyStore.TakeCeremony(ctx, id)
+}
+
+type instrumentedTwoFactorStore struct {
+	twofactor.TwoFactorStore
+	m *Metrics
+}
+
+func InstrumentTwoFactorStore(store twofactor.TwoFactorStore, m *Metrics) twofactor.TwoFactorStore {
+	return &instrumentedTwoFactorStore{TwoFactorStore: store, m: m}
+}
+
+func (s *instrumentedTwoFactorStore) SetPending(ctx context.Context, email, secret string) error {
+	defer s.m.ObserveQuery("totp", "set_pending")()
+	return s.TwoFactorStore.SetPending(ctx, email, secret)
+}
+
+func (s *instrumentedTwoFactorStore) Pending(ctx context.Context, email string) (string, error) {
+	defer s.m.ObserveQuery("totp", "pending")()
+	return s.TwoFactorStore.Pending(ctx, email)
+}
+
+func (s *instrumentedTwoFactorStore) Confirm(ctx context.Context, email, secret string, step int64, recoveryCodeHashes []string) error {
+	defer s.m.ObserveQuery("totp", "confirm")()
+	return s.TwoFactorStore.Confirm(ctx, email, secret, step, recoveryCodeHashes)
+}
+
+func (s *instrumentedTwoFactorStore) Secret(ctx context.Context, email string) (string, error) {
+	defer s.m.ObserveQuery("totp", "secret")()
+	return s.TwoFactorStore.Secret(ctx, email)
+}
+
+func (s *instrumentedTwoFactorStore) UseStep(ctx context.Context, email string, step int64) error {
+	defer s.m.ObserveQuery("totp", "use_step")()
+	return s.TwoFactorStore.UseStep(ctx, email, step)
+}
+
+func (s *instrumentedTwoFactorStore) UseRecoveryCode(ctx context.Context, email, codeHash string) error {
+	defer s.m.ObserveQuery("totp", "use_recovery_code")()
+	return s.TwoFactorStore.UseRecoveryCode(ctx, email, codeHash)
+}
+
+func (s *instrumentedTwoFactorStore) RecoveryCodesLeft(ctx context.Context, email string) (int, error) {
+	defer s.m.ObserveQuery("totp", "recovery_codes_left")()
+	return s.TwoFactorStore.RecoveryCodesLeft(ctx, email)
+}
+
+func (s *instrumentedTwoFactorStore) Disable(ctx context.Context, email string) error {
+	defer s.m.ObserveQuery("totp", "disable")()
+	return s.TwoFactorStore.Disable(ctx, email)
+}
+
+type instrumentedFeedTokenStore struct {
+	feedtokens.FeedTokenStore
+	m *Metrics
+}
+
+func InstrumentFeedTokenStore(store feedtokens.FeedTokenStore, m *Metrics) feedtokens.FeedTokenStore {
+	return &instrumentedFeedTokenStore{FeedTokenStore: store, m: m}
+}
+
+func (s *instrumentedFeedTokenStore) Create(email string) (string, error) {
+	defer s.m.ObserveQuery("feed_tokens", "create")()
+	return s.FeedTokenStore.Create(email)
+}
+
+func (s *instrumentedFeedTokenStore) Active(email string) (feedtokens.FeedToken, bool, error) {
+	defer s.m.ObserveQuery("feed_tokens", "active")()
+	return s.FeedTokenStore.Active(email)
+}
+
+func (s *instrumentedFeedTokenStore) Lookup(token string) (string, error) {
+	defer s.m.ObserveQuery("feed_tokens", "lookup")()
+	return s.FeedTokenStore.Lookup(token)
+}
+
+func (s *instrumentedFeedTokenStore) Revoke(email string) error {
+	defer s.m.ObserveQuery("feed_tokens", "revoke")()
+	return s.FeedTokenStore.Revoke(email)
+}
+
+type instrumentedAPITokenStore struct {
+	apitokens.APITokenStore
+	m *Metrics
+}
+
+func InstrumentAPITokenStore(store apitokens.APITokenStore, m *Metrics) apitokens.APITokenStore {
+	return &instrumentedAPITokenStore{APITokenStore: store, m: m}
+}
+
+func (s *instrumentedAPITokenStore) Create(name string, scopes []string) (string, error) {
+	defer s.m.ObserveQuery("api_tokens", "create")()
+	return s.APITokenStore.Create(name, scopes)
+}
+
+func (s *instrumentedAPITokenStore) Lookup(token string) (apitokens.APIToken, error) {
+	defer s.m.ObserveQuery("api_tokens", "lookup")()
+	return s.APITokenStore.Lookup(token)
+}
+
+func (s *instrumentedAPITokenStore) Revoke(name string) error {
+	defer s.m.ObserveQuery("api_tokens", "revoke")()
+	return s.APITokenStore.Revoke(name)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Metrics holds the operational metrics of the server, registered on
+// their own registry so they can be served separately from the event
+// aggregates.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	HTTPRequestDuration *prometheus.HistogramVec
+	DBQueryDuration     *prometheus.HistogramVec
+	EmailsSent          *prometheus.CounterVec
+	LoginAttempts       *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		DBQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Duration of database queries by store and operation.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"store", "operation"}),
+		EmailsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_sent_total",
+			Help: "Emails handed to the SMTP server, by result (sent or failed).",
+		}, []string{"result"}),
+		LoginAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "login_attempts_total",
+			Help: "Login attempts by stage (request or verify) and result.",
+		}, []string{"stage", "result"}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.HTTPRequestDuration,
+		m.DBQueryDuration,
+		m.EmailsSent,
+		m.LoginAttempts,
+	)
+	return m
+}
+
+// ObserveQuery starts timing a database query. Call the returned function
+// once the query has finished:
+//
+//	defer m.ObserveQuery("events", "record")()
+func (m *Metrics) ObserveQuery(store, operation string) func() {
+	start := time.Now()
+	return func() {
+		m.DBQueryDuration.WithLabelValues(store, operation).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,206 @@
+// Package passkeys lets users log in with WebAuthn credentials they
+// registered while logged in. Magic links remain the way in for users
+// without a passkey at hand.
+package passkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ceremonyTimeout is how long the browser has to answer a challenge.
+const ceremonyTimeout = 5 * time.Minute
+
+// ErrCloned means a passkey's signature counter didn't increase, i.e. the
+// credential may have been copied off its authenticator.
+var ErrCloned = errors.New("passkey signature counter went backwards")
+
+type Service struct {
+	webauthn *webauthn.WebAuthn
+	store    PasskeyStore
+}
+
+// New returns the service for the relying party at appOrigin. Passkeys
+// are bound to its host name.
+func New(appOrigin string, store PasskeyStore) (*Service, error) {
+	u, err := url.Parse(appOrigin)
+	if err != nil {
+		return nil, err
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "Rechenschaftspflicht",
+		RPOrigins:     []string{appOrigin},
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Service{webauthn: w, store: store}, nil
+}
+
+// user adapts a user to webauthn.User.
+type user struct {
+	email       string
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (u user) WebAuthnID() []byte                         { return u.handle }
+func (u user) WebAuthnName() string                       { return u.email }
+func (u user) WebAuthnDisplayName() string                { return u.email }
+func (u user) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func (s *Service) loadUser(ctx context.Context, email string) (user, error) {
+	handle, err := s.store.Handle(ctx, email)
+	if err != nil {
+		return user{}, err
+	}
+	passkeys, err := s.store.List(ctx, email)
+	if err != nil {
+		return user{}, err
+	}
+	u := user{email: email, handle: handle}
+	for _, p := range passkeys {
+		u.credentials = append(u.credentials, p.Credential)
+	}
+	return u, nil
+}
+
+func (s *Service) saveCeremony(ctx context.Context, data *webauthn.SessionData) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	ceremonyID := hex.EncodeToString(id)
+	if err := s.store.SaveCeremony(ctx, ceremonyID, *data, time.Now().Add(ceremonyTimeout)); err != nil {
+		return "", err
+	}
+	return ceremonyID, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create
+// and the ID of the ceremony to pass to FinishRegistration.
+func (s *Service) BeginRegistration(ctx context.Context, email string) (*protocol.CredentialCreation, string, error) {
+	u, err := s.loadUser(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+	creation, data, err := s.webauthn.BeginRegistration(u,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(u.credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	ceremonyID, err := s.saveCeremony(ctx, data)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, ceremonyID, nil
+}
+
+// FinishRegistration verifies the browser's response, read from body, and
+// stores the new passkey under name.
+func (s *Service) FinishRegistration(ctx context.Context, email, name, ceremonyID string, body io.Reader) error {
+	data, err := s.store.TakeCeremony(ctx, ceremonyID)
+	if err != nil {
+		return err
+	}
+	u, err := s.loadUser(ctx, email)
+	if err != nil {
+		return err
+	}
+	response, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return err
+	}
+	// Checks that the ceremony was started for this user.
+	credential, err := s.webauthn.CreateCredential(u, data, response)
+	if err != nil {
+		return err
+	}
+	return s.store.Add(ctx, email, Passkey{
+		Name:       name,
+		CreatedAt:  timestamp(time.Now()),
+		Credential: *credential,
+	})
+}
+
+// BeginLogin returns the options for navigator.credentials.get and the ID
+// of the ceremony to pass to FinishLogin. Any of the user's passkeys will
+// do, so the user doesn't have to say who they are first.
+func (s *Service) BeginLogin(ctx context.Context) (*protocol.CredentialAssertion, string, error) {
+	assertion, data, err := s.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, "", err
+	}
+	ceremonyID, err := s.saveCeremony(ctx, data)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, ceremonyID, nil
+}
+
+// FinishLogin verifies the browser's response, read from body, and returns
+// the email of the user it logs in. It fails with ErrCloned if the
+// passkey's signature counter suggests it was copied.
+func (s *Service) FinishLogin(ctx context.Context, ceremonyID string, body io.Reader) (string, error) {
+	data, err := s.store.TakeCeremony(ctx, ceremonyID)
+	if err != nil {
+		return "", err
+	}
+	response, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return "", err
+	}
+
+	var email string
+	lookup := func(_, handle []byte) (webauthn.User, error) {
+		owner, err := s.store.Owner(ctx, handle)
+		if err != nil {
+			return nil, err
+		}
+		u, err := s.loadUser(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(u.handle, handle) {
+			return nil, ErrNotFound
+		}
+		email = owner
+		return u, nil
+	}
+	credential, err := s.webauthn.ValidateDiscoverableLogin(lookup, data, response)
+	if err != nil {
+		return "", err
+	}
+	if credential.Authenticator.CloneWarning {
+		return email, fmt.Errorf("%w: passkey %x", ErrCloned, credential.ID)
+	}
+	if err := s.store.Used(ctx, email, *credential); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// List returns the user's passkeys.
+func (s *Service) List(ctx context.Context, email string) ([]Passkey, error) {
+	return s.store.List(ctx, email)
+}
+
+// Remove deletes one of the user's passkeys.
+func (s *Service) Remove(ctx context.Context, email string, credentialID []byte) error {
+	return s.store.Remove(ctx, email, credentialID)
+}
@@ -0,0 +1,310 @@
+package passkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const origin = "https://app.example.com"
+
+// memoryStore is a PasskeyStore that ignores expiry.
+type memoryStore struct {
+	handles    map[string][]byte
+	passkeys   map[string][]Passkey
+	ceremonies map[string]webauthn.SessionData
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		handles:    map[string][]byte{},
+		passkeys:   map[string][]Passkey{},
+		ceremonies: map[string]webauthn.SessionData{},
+	}
+}
+
+func (m *memoryStore) Handle(_ context.Context, email string) ([]byte, error) {
+	if _, ok := m.handles[email]; !ok {
+		m.handles[email] = []byte("handle-" + email)
+	}
+	return m.handles[email], nil
+}
+
+func (m *memoryStore) Owner(_ context.Context, handle []byte) (string, error) {
+	for email, h := range m.handles {
+		if bytes.Equal(h, handle) {
+			return email, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *memoryStore) Add(_ context.Context, email string, passkey Passkey) error {
+	m.passkeys[email] = append(m.passkeys[email], passkey)
+	return nil
+}
+
+func (m *memoryStore) List(_ context.Context, email string) ([]Passkey, error) {
+	return m.passkeys[email], nil
+}
+
+func (m *memoryStore) Used(_ context.Context, email string, credential webauthn.Credential) error {
+	for i, p := range m.passkeys[email] {
+		if bytes.Equal(p.Credential.ID, credential.ID) {
+			m.passkeys[email][i].Credential = credential
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Remove(_ context.Context, email string, credentialID []byte) error {
+	var kept []Passkey
+	for _, p := range m.passkeys[email] {
+		if !bytes.Equal(p.Credential.ID, credentialID) {
+			kept = append(kept, p)
+		}
+	}
+	m.passkeys[email] = kept
+	return nil
+}
+
+func (m *memoryStore) SaveCeremony(_ context.Context, id string, data webauthn.SessionData, _ time.Time) error {
+	m.ceremonies[id] = data
+	return nil
+}
+
+func (m *memoryStore) TakeCeremony(_ context.Context, id string) (webauthn.SessionData, error) {
+	data, ok := m.ceremonies[id]
+	if !ok {
+		return webauthn.SessionData{}, ErrNotFound
+	}
+	delete(m.ceremonies, id)
+	return data, nil
+}
+
+// softwareAuthenticator plays the part of the browser and a platform
+// authenticator holding a single passkey.
+type softwareAuthenticator struct {
+	t       *testing.T
+	key     *ecdsa.PrivateKey
+	id      []byte
+	handle  []byte
+	counter uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return &softwareAuthenticator{t: t, key: key, id: id}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *softwareAuthenticator) clientData(typ, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// authData builds authenticator data with user presence and verification
+// flags set, and attested credential data if attested is given.
+func (a *softwareAuthenticator) authData(rpID string, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested != nil {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func (a *softwareAuthenticator) create(creation *protocol.CredentialCreation) []byte {
+	options := creation.Response
+	a.handle = options.User.ID.(protocol.URLEncodedBase64)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(options.RelyingParty.ID, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    b64(a.clientData("webauthn.create", options.Challenge.String())),
+		"attestationObject": b64(attestation),
+	})
+}
+
+func (a *softwareAuthenticator) get(assertion *protocol.CredentialAssertion) []byte {
+	options := assertion.Response
+	a.counter++
+	authData := a.authData(options.RelyingPartyID, nil)
+	clientData := a.clientData("webauthn.get", options.Challenge.String())
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(signature),
+		"userHandle":        b64(a.handle),
+	})
+}
+
+func (a *softwareAuthenticator) response(fields map[string]string) []byte {
+	body, err := json.Marshal(map[string]any{
+		"id":       b64(a.id),
+		"rawId":    b64(a.id),
+		"type":     "public-key",
+		"response": fields,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+func newTestService(t *testing.T) *Service {
+	s, err := New(origin, newMemoryStore())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func register(t *testing.T, s *Service, a *softwareAuthenticator, email string) {
+	t.Helper()
+	ctx := context.Background()
+	creation, ceremony, err := s.BeginRegistration(ctx, email)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.FinishRegistration(ctx, email, "laptop", ceremony, bytes.NewReader(a.create(creation))); err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+}
+
+func login(t *testing.T, s *Service, a *softwareAuthenticator) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+	assertion, ceremony, err := s.BeginLogin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s.FinishLogin(ctx, ceremony, bytes.NewReader(a.get(assertion)))
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := newTestService(t)
+	a := newSoftwareAuthenticator(t)
+	register(t, s, a, "user@example.com")
+
+	for i := 0; i < 2; i++ {
+		email, err := login(t, s, a)
+		if err != nil {
+			t.Fatalf("login %d failed: %v", i+1, err)
+		}
+		if email != "user@example.com" {
+			t.Errorf("expected user@example.com, got %q", email)
+		}
+	}
+
+	passkeys, _ := s.List(context.Background(), "user@example.com")
+	if len(passkeys) != 1 || passkeys[0].Credential.Authenticator.SignCount != 2 {
+		t.Errorf("expected one passkey with sign count 2, got %+v", passkeys)
+	}
+}
+
+func TestLoginRejectsClonedPasskey(t *testing.T) {
+	s := newTestService(t)
+	a := newSoftwareAuthenticator(t)
+	register(t, s, a, "user@example.com")
+
+	if _, err := login(t, s, a); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	// A copy of the key that hasn't seen the first login reuses its
+	// counter value.
+	a.counter--
+	if _, err := login(t, s, a); !errors.Is(err, ErrCloned) {
+		t.Errorf("expected %v, got %v", ErrCloned, err)
+	}
+}
+
+func TestLoginWithRemovedPasskeyFails(t *testing.T) {
+	s := newTestService(t)
+	a := newSoftwareAuthenticator(t)
+	register(t, s, a, "user@example.com")
+
+	if err := s.Remove(context.Background(), "user@example.com", a.id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := login(t, s, a); err == nil {
+		t.Error("expected login with a removed passkey to fail")
+	}
+}
+
+func TestCeremonyCannotBeReplayed(t *testing.T) {
+	s := newTestService(t)
+	a := newSoftwareAuthenticator(t)
+	register(t, s, a, "user@example.com")
+
+	ctx := context.Background()
+	assertion, ceremony, err := s.BeginLogin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response := a.get(assertion)
+	if _, err := s.FinishLogin(ctx, ceremony, bytes.NewReader(response)); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if _, err := s.FinishLogin(ctx, ceremony, bytes.NewReader(response)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected replayed response to fail with %v, got %v", ErrNotFound, err)
+	}
+}
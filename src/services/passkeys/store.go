@@ -0,0 +1,184 @@
+package passkeys
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ErrNotFound is returned for unknown users, passkeys and ceremonies.
+var ErrNotFound = errors.New("not found")
+
+// Passkey is a registered credential with the name its user gave it.
+// Times are RFC 3339 strings in UTC; LastUsedAt is empty until first use.
+type Passkey struct {
+	Name       string
+	CreatedAt  string
+	LastUsedAt string
+	Credential webauthn.Credential
+}
+
+// PasskeyStore persists users' passkeys and the state of ceremonies in
+// progress.
+type PasskeyStore interface {
+	// Handle returns the user's WebAuthn user handle, creating it on first
+	// use. Handles are random so they reveal nothing about the user.
+	Handle(ctx context.Context, email string) ([]byte, error)
+	// Owner returns the email of the user with the handle.
+	Owner(ctx context.Context, handle []byte) (string, error)
+	Add(ctx context.Context, email string, passkey Passkey) error
+	List(ctx context.Context, email string) ([]Passkey, error)
+	// Used saves the credential's state after a login, notably its
+	// signature counter.
+	Used(ctx context.Context, email string, credential webauthn.Credential) error
+	Remove(ctx context.Context, email string, credentialID []byte) error
+	// SaveCeremony keeps a ceremony's state until TakeCeremony returns it,
+	// which it does only once.
+	SaveCeremony(ctx context.Context, id string, data webauthn.SessionData, expiresAt time.Time) error
+	TakeCeremony(ctx context.Context, id string) (webauthn.SessionData, error)
+}
+
+type SQLitePasskeyStore struct {
+	db *sql.DB
+}
+
+func NewPasskeyStore(db *sql.DB) PasskeyStore {
+	return &SQLitePasskeyStore{db: db}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (s *SQLitePasskeyStore) Handle(ctx context.Context, email string) ([]byte, error) {
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+	const insert = `INSERT OR IGNORE INTO passkey_users (email, handle) VALUES (LOWER(?), ?);`
+	if _, err := s.db.ExecContext(ctx, insert, email, handle); err != nil {
+		return nil, err
+	}
+
+	var stored []byte
+	err := s.db.QueryRowContext(ctx, `SELECT handle FROM passkey_users WHERE email = LOWER(?);`, email).Scan(&stored)
+	return stored, err
+}
+
+func (s *SQLitePasskeyStore) Owner(ctx context.Context, handle []byte) (string, error) {
+	var email string
+	err := s.db.QueryRowContext(ctx, `SELECT email FROM passkey_users WHERE handle = ?;`, handle).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return email, err
+}
+
+func (s *SQLitePasskeyStore) Add(ctx context.Context, email string, passkey Passkey) error {
+	credential, err := json.Marshal(passkey.Credential)
+	if err != nil {
+		return err
+	}
+	const insert = `
+		INSERT INTO passkeys (id, email, name, credential, createdAt)
+		VALUES (?, LOWER(?), ?, ?, ?);
+	`
+	_, err = s.db.ExecContext(ctx, insert, passkey.Credential.ID, email, passkey.Name, string(credential), passkey.CreatedAt)
+	return err
+}
+
+func (s *SQLitePasskeyStore) List(ctx context.Context, email string) (passkeys []Passkey, err error) {
+	const query = `
+		SELECT name, createdAt, COALESCE(lastUsedAt, ''), credential
+		FROM passkeys
+		WHERE email = LOWER(?)
+		ORDER BY createdAt;
+	`
+	rows, err := s.db.QueryContext(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	for rows.Next() {
+		var passkey Passkey
+		var credential string
+		if err := rows.Scan(&passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt, &credential); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(credential), &passkey.Credential); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s *SQLitePasskeyStore) Used(ctx context.Context, email string, credential webauthn.Credential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	const update = `UPDATE passkeys SET credential = ?, lastUsedAt = ? WHERE id = ? AND email = LOWER(?);`
+	_, err = s.db.ExecContext(ctx, update, string(data), timestamp(time.Now()), credential.ID, email)
+	return err
+}
+
+func (s *SQLitePasskeyStore) Remove(ctx context.Context, email string, credentialID []byte) error {
+	const remove = `DELETE FROM passkeys WHERE id = ? AND email = LOWER(?);`
+	_, err := s.db.ExecContext(ctx, remove, credentialID, email)
+	return err
+}
+
+func (s *SQLitePasskeyStore) SaveCeremony(ctx context.Context, id string, data webauthn.SessionData, expiresAt time.Time) error {
+	// Abandoned ceremonies are useless to keep around.
+	const prune = `DELETE FROM passkey_ceremonies WHERE expiresAt < ?;`
+	if _, err := s.db.ExecContext(ctx, prune, timestamp(time.Now())); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	const insert = `INSERT INTO passkey_ceremonies (id, data, expiresAt) VALUES (?, ?, ?);`
+	_, err = s.db.ExecContext(ctx, insert, id, string(encoded), timestamp(expiresAt))
+	return err
+}
+
+func (s *SQLitePasskeyStore) TakeCeremony(ctx context.Context, id string) (webauthn.SessionData, error) {
+	var encoded string
+	const query = `SELECT data FROM passkey_ceremonies WHERE id = ? AND expiresAt >= ?;`
+	err := s.db.QueryRowContext(ctx, query, id, timestamp(time.Now())).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webauthn.SessionData{}, ErrNotFound
+	}
+	if err != nil {
+		return webauthn.SessionData{}, err
+	}
+
+	// Only the request that deletes the row may use it, so a challenge
+	// can't be answered twice.
+	res, err := s.db.ExecContext(ctx, `DELETE FROM passkey_ceremonies WHERE id = ?;`, id)
+	if err != nil {
+		return webauthn.SessionData{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return webauthn.SessionData{}, err
+	} else if n == 0 {
+		return webauthn.SessionData{}, ErrNotFound
+	}
+
+	var data webauthn.SessionData
+	err = json.Unmarshal([]byte(encoded), &data)
+	return data, err
+}
@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryStore drops expired state.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps state in process memory.
+type MemoryStore struct {
+	mu        sync.Mutex
+	states    map[string]State
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: map[string]State{}}
+}
+
+func (m *MemoryStore) Update(_ context.Context, key string, fn func(*State)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > sweepInterval {
+		for k, s := range m.states {
+			if now.After(s.ExpiresAt) {
+				delete(m.states, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	s := m.states[key]
+	fn(&s)
+	m.states[key] = s
+	return nil
+}
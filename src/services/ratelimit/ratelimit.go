@@ -0,0 +1,108 @@
+// Package ratelimit limits how often something may be done per key, such
+// as an email address or client IP, with exponentially growing waits for
+// keys that keep trying.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Policy allows Burst attempts per key. After that, each attempt blocks
+// the key for BaseDelay, doubling with every further attempt up to
+// MaxDelay. A key's count resets once it has been quiet for Window.
+type Policy struct {
+	Burst     int
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// State is what a Store keeps per key.
+type State struct {
+	Count        int
+	LastAttempt  time.Time
+	BlockedUntil time.Time
+	// ExpiresAt is when the state no longer matters and may be dropped.
+	ExpiresAt time.Time
+}
+
+// Store holds the per-key state. The in-memory store suits a single
+// instance; a shared store lets several instances enforce one limit.
+type Store interface {
+	// Update applies fn to the key's state, the zero State if there is
+	// none, and saves the result. It must be atomic per key.
+	Update(ctx context.Context, key string, fn func(*State)) error
+}
+
+type Limiter struct {
+	name   string
+	store  Store
+	policy Policy
+	now    func() time.Time
+}
+
+// New returns a limiter keeping its state in store under keys prefixed
+// with name, so limiters can share a store.
+func New(name string, store Store, policy Policy) *Limiter {
+	return &Limiter{name: name, store: store, policy: policy, now: time.Now}
+}
+
+// Name identifies the limiter in logs.
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Allow records an attempt for key. If the key is blocked, the attempt is
+// not counted and Allow returns false and how long until the next attempt
+// is allowed.
+func (l *Limiter) Allow(ctx context.Context, key string) (ok bool, retryAfter time.Duration, err error) {
+	now := l.now()
+	err = l.store.Update(ctx, l.name+":"+key, func(s *State) {
+		if now.Before(s.BlockedUntil) {
+			retryAfter = s.BlockedUntil.Sub(now)
+			return
+		}
+		ok = true
+
+		if now.Sub(s.LastAttempt) > l.policy.Window {
+			s.Count = 0
+		}
+		s.Count++
+		s.LastAttempt = now
+		if s.Count >= l.policy.Burst {
+			s.BlockedUntil = now.Add(l.delay(s.Count - l.policy.Burst))
+		}
+		s.ExpiresAt = s.LastAttempt.Add(l.policy.Window)
+		if s.BlockedUntil.After(s.ExpiresAt) {
+			s.ExpiresAt = s.BlockedUntil
+		}
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return ok, retryAfter, nil
+}
+
+// Blocked returns how long key is still blocked, zero if it isn't, without
+// recording an attempt. With Allow recording only failures, it limits
+// failed attempts rather than all of them.
+func (l *Limiter) Blocked(ctx context.Context, key string) (time.Duration, error) {
+	now := l.now()
+	var retryAfter time.Duration
+	err := l.store.Update(ctx, l.name+":"+key, func(s *State) {
+		if now.Before(s.BlockedUntil) {
+			retryAfter = s.BlockedUntil.Sub(now)
+		}
+	})
+	return retryAfter, err
+}
+
+// delay returns BaseDelay doubled n times, capped at MaxDelay.
+func (l *Limiter) delay(n int) time.Duration {
+	d := l.policy.BaseDelay
+	for i := 0; i < n && d < l.policy.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, l.policy.MaxDelay)
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) *Limiter {
+	l := New("test", NewMemoryStore(), Policy{
+		Burst:     3,
+		Window:    time.Hour,
+		BaseDelay: time.Minute,
+		MaxDelay:  10 * time.Minute,
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func allow(t *testing.T, l *Limiter, key string) (bool, time.Duration) {
+	t.Helper()
+	ok, retryAfter, err := l.Allow(context.Background(), key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return ok, retryAfter
+}
+
+func TestLimiterBacksOffExponentially(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := allow(t, l, "a"); !ok {
+			t.Fatalf("attempt %d: expected burst to be allowed", i+1)
+		}
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute} {
+		ok, retryAfter := allow(t, l, "a")
+		if ok {
+			t.Fatal("expected attempt after burst to be blocked")
+		}
+		if retryAfter != want {
+			t.Fatalf("expected to wait %v, got %v", want, retryAfter)
+		}
+		now = now.Add(retryAfter)
+		if ok, _ := allow(t, l, "a"); !ok {
+			t.Fatalf("expected attempt after waiting %v to be allowed", retryAfter)
+		}
+	}
+}
+
+func TestLimiterKeysAreIndependent(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		allow(t, l, "a")
+	}
+	if ok, _ := allow(t, l, "a"); ok {
+		t.Fatal("expected a to be blocked")
+	}
+	if ok, _ := allow(t, l, "b"); !ok {
+		t.Error("expected b to be unaffected by a")
+	}
+}
+
+func TestLimiterResetsAfterQuietWindow(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		allow(t, l, "a")
+	}
+	now = now.Add(time.Hour + time.Second)
+	for i := 0; i < 3; i++ {
+		if ok, _ := allow(t, l, "a"); !ok {
+			t.Fatalf("attempt %d: expected a fresh burst after a quiet window", i+1)
+		}
+	}
+}
+
+func TestBlockedDoesNotCountAttempts(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 10; i++ {
+		if retryAfter, err := l.Blocked(context.Background(), "a"); err != nil || retryAfter != 0 {
+			t.Fatalf("expected key not to be blocked, got %v, %v", retryAfter, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		allow(t, l, "a")
+	}
+	if retryAfter, _ := l.Blocked(context.Background(), "a"); retryAfter != time.Minute {
+		t.Errorf("expected key to be blocked for %v, got %v", time.Minute, retryAfter)
+	}
+}
@@ -0,0 +1,53 @@
+// Package requestid carries the ID that correlates a request across log
+// lines, outgoing emails and the error pages shown to users.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Header is the HTTP and email header carrying the request ID.
+const Header = "X-Request-ID"
+
+// maxLength bounds IDs accepted from clients.
+const maxLength = 128
+
+// New returns a random request ID.
+func New() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether id is safe to accept from a client and to echo in
+// headers, logs and pages: non-empty, at most 128 characters, and made up
+// of letters, digits, dots, dashes and underscores.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type ctxKey struct{}
+
+// WithID returns a context carrying id.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
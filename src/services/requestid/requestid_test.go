@@ -0,0 +1,31 @@
+package requestid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	cases := map[string]bool{
+		"":                               false,
+		"abc-123_DEF.4":                  true,
+		New():                            true,
+		strings.Repeat("a", maxLength):   true,
+		strings.Repeat("a", maxLength+1): false,
+		"with space":                     false,
+		"line\nbreak":                    false,
+		"<script>":                       false,
+		"ümlaut":                         false,
+	}
+	for id, want := range cases {
+		if got := Valid(id); got != want {
+			t.Errorf("Valid(%q): expected %v, got %v", id, want, got)
+		}
+	}
+}
+
+func TestNewIDsDiffer(t *testing.T) {
+	if New() == New() {
+		t.Error("expected two new IDs to differ")
+	}
+}
@@ -0,0 +1,145 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned for sessions that don't exist, have been revoked
+// or have expired.
+var ErrNotFound = errors.New("session not found")
+
+// Session is a login on one device. Times are RFC 3339 strings in UTC.
+type Session struct {
+	ID         string
+	Email      string
+	UserAgent  string
+	IP         string
+	CreatedAt  string
+	LastSeenAt string
+	ExpiresAt  string
+}
+
+// SessionStore persists sessions so they can be listed and revoked before
+// their tokens expire.
+type SessionStore interface {
+	Create(ctx context.Context, session Session) error
+	// Get returns an active session.
+	Get(ctx context.Context, id string) (Session, error)
+	// Touch records activity and extends the session to expiresAt. An
+	// earlier expiresAt, from a token issued before a renewal, is ignored.
+	Touch(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error
+	// Active lists the user's active sessions, most recently used first.
+	Active(ctx context.Context, email string) ([]Session, error)
+	// Revoke ends one of the user's sessions.
+	Revoke(ctx context.Context, email, id string) error
+	// RevokeAll ends all of the user's sessions.
+	RevokeAll(ctx context.Context, email string) error
+}
+
+type SQLiteSessionStore struct {
+	db *sql.DB
+}
+
+func NewSessionStore(db *sql.DB) SessionStore {
+	return &SQLiteSessionStore{db: db}
+}
+
+func Timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (s *SQLiteSessionStore) Create(ctx context.Context, session Session) error {
+	// Expired sessions are useless to keep around.
+	const prune = `DELETE FROM sessions WHERE expiresAt < ?;`
+	if _, err := s.db.ExecContext(ctx, prune, Timestamp(time.Now())); err != nil {
+		return err
+	}
+
+	const insert = `
+		INSERT INTO sessions (id, email, userAgent, ip, createdAt, lastSeenAt, expiresAt)
+		VALUES (?, LOWER(?), ?, ?, ?, ?, ?);
+	`
+	_, err := s.db.ExecContext(ctx, insert,
+		session.ID, session.Email, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt,
+	)
+	return err
+}
+
+const selectActive = `
+	SELECT id, email, userAgent, ip, createdAt, lastSeenAt, expiresAt
+	FROM sessions
+	WHERE revokedAt IS NULL AND expiresAt >= ?
+`
+
+func scan(row interface{ Scan(...any) error }) (Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.ID, &session.Email, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt,
+	)
+	return session, err
+}
+
+func (s *SQLiteSessionStore) Get(ctx context.Context, id string) (Session, error) {
+	row := s.db.QueryRowContext(ctx, selectActive+` AND id = ?;`, Timestamp(time.Now()), id)
+	session, err := scan(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *SQLiteSessionStore) Touch(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) error {
+	// RFC 3339 timestamps in UTC sort as strings.
+	const update = `UPDATE sessions SET lastSeenAt = ?, expiresAt = MAX(expiresAt, ?) WHERE id = ?;`
+	_, err := s.db.ExecContext(ctx, update, Timestamp(lastSeenAt), Timestamp(expiresAt), id)
+	return err
+}
+
+func (s *SQLiteSessionStore) Active(ctx context.Context, email string) (sessions []Session, err error) {
+	rows, err := s.db.QueryContext(ctx,
+		selectActive+` AND LOWER(email) = LOWER(?) ORDER BY lastSeenAt DESC;`,
+		Timestamp(time.Now()), email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	for rows.Next() {
+		session, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLiteSessionStore) Revoke(ctx context.Context, email, id string) error {
+	const revoke = `
+		UPDATE sessions
+		SET revokedAt = ?
+		WHERE id = ? AND LOWER(email) = LOWER(?) AND revokedAt IS NULL;
+	`
+	_, err := s.db.ExecContext(ctx, revoke, Timestamp(time.Now()), id, email)
+	return err
+}
+
+func (s *SQLiteSessionStore) RevokeAll(ctx context.Context, email string) error {
+	const revoke = `
+		UPDATE sessions
+		SET revokedAt = ?
+		WHERE LOWER(email) = LOWER(?) AND revokedAt IS NULL;
+	`
+	_, err := s.db.ExecContext(ctx, revoke, Timestamp(time.Now()), email)
+	return err
+}
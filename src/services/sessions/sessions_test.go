@@ -0,0 +1,144 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/config"
+	database "github.com/erkannt/rechenschaftspflicht/services/db"
+)
+
+func newTestStore(t *testing.T) SessionStore {
+	t.Helper()
+	db, err := database.InitDB(config.Config{SqlitePath: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return NewSessionStore(db)
+}
+
+// create adds a session for email last seen at lastSeenAt and valid for
+// another hour.
+func create(t *testing.T, s SessionStore, id, email string, lastSeenAt time.Time) {
+	t.Helper()
+	err := s.Create(context.Background(), Session{
+		ID:         id,
+		Email:      email,
+		CreatedAt:  Timestamp(lastSeenAt),
+		LastSeenAt: Timestamp(lastSeenAt),
+		ExpiresAt:  Timestamp(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func ids(sessions []Session) []string {
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+func TestActiveListsMostRecentlyUsedFirst(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	create(t, s, "laptop", "user@example.com", now.Add(-time.Hour))
+	create(t, s, "phone", "User@Example.com", now.Add(-time.Minute))
+	create(t, s, "tablet", "user@example.com", now.Add(-2*time.Hour))
+	create(t, s, "theirs", "other@example.com", now)
+
+	active, err := s.Active(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(active); len(got) != 3 || got[0] != "phone" || got[1] != "laptop" || got[2] != "tablet" {
+		t.Errorf("expected phone, laptop, tablet, got %v", got)
+	}
+}
+
+func TestRevokeIsScopedToTheUser(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	create(t, s, "mine", "user@example.com", time.Now())
+	create(t, s, "theirs", "other@example.com", time.Now())
+
+	if err := s.Revoke(ctx, "user@example.com", "theirs"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Get(ctx, "theirs"); err != nil {
+		t.Errorf("expected another user's session to survive, got %v", err)
+	}
+
+	if err := s.Revoke(ctx, "user@example.com", "mine"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Get(ctx, "mine"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v for a revoked session, got %v", ErrNotFound, err)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	create(t, s, "laptop", "user@example.com", time.Now())
+	create(t, s, "phone", "user@example.com", time.Now())
+	create(t, s, "theirs", "other@example.com", time.Now())
+
+	if err := s.RevokeAll(ctx, "USER@example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if active, err := s.Active(ctx, "user@example.com"); err != nil || len(active) != 0 {
+		t.Errorf("expected no active sessions, got %v, %v", ids(active), err)
+	}
+	if active, err := s.Active(ctx, "other@example.com"); err != nil || len(active) != 1 {
+		t.Errorf("expected another user's session to survive, got %v, %v", ids(active), err)
+	}
+}
+
+func TestTouchNeverShortensExpiry(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	create(t, s, "laptop", "user@example.com", now.Add(-time.Hour))
+
+	extended := now.Add(2 * time.Hour)
+	if err := s.Touch(ctx, "laptop", now, extended); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Touch(ctx, "laptop", now.Add(time.Second), now.Add(-time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	session, err := s.Get(ctx, "laptop")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.ExpiresAt != Timestamp(extended) {
+		t.Errorf("expected expiry %s, got %s", Timestamp(extended), session.ExpiresAt)
+	}
+	if session.LastSeenAt != Timestamp(now.Add(time.Second)) {
+		t.Errorf("expected last seen %s, got %s", Timestamp(now.Add(time.Second)), session.LastSeenAt)
+	}
+}
+
+func TestExpiredSessionsAreNotFound(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	err := s.Create(ctx, Session{
+		ID:        "old",
+		Email:     "user@example.com",
+		ExpiresAt: Timestamp(time.Now().Add(-time.Minute)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Get(ctx, "old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Package sso logs users in through an OpenID Connect provider, using the
+// authorization code flow with PKCE. It only establishes who the provider
+// says the user is; whether they may log in is up to the caller.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrDenied means the provider didn't authenticate the user, e.g.
+	// because they cancelled.
+	ErrDenied = errors.New("provider denied login")
+	// ErrMismatch means a callback doesn't answer the login the browser
+	// began, i.e. its state or the ID token's nonce is wrong.
+	ErrMismatch = errors.New("callback doesn't match login")
+	// ErrUnverifiedEmail means the provider doesn't vouch for the user's
+	// email address.
+	ErrUnverifiedEmail = errors.New("email not verified by provider")
+)
+
+type Provider struct {
+	name         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	// Discovery happens on first use, so the server starts while the
+	// provider is down.
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New returns the provider at issuer, displayed as name. The provider
+// redirects users back to redirectURL.
+func New(name, issuer, clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		name:         name,
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+	}
+}
+
+// Name is what users know the provider as.
+func (p *Provider) Name() string {
+	return p.name
+}
+
+func (p *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", p.issuer, err)
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  p.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.clientID})
+	return p.oauth, p.verifier, nil
+}
+
+// Flow is what Finish needs to check a callback. It must stay with the
+// browser that began the login, and nowhere else.
+type Flow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func (f Flow) String() string {
+	return f.State + "." + f.Nonce + "." + f.Verifier
+}
+
+// ParseFlow is the inverse of Flow.String.
+func ParseFlow(s string) (Flow, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return Flow{}, ErrMismatch
+	}
+	return Flow{State: parts[0], Nonce: parts[1], Verifier: parts[2]}, nil
+}
+
+func random() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Begin returns the provider URL to send the user to and the flow to keep
+// for Finish.
+func (p *Provider) Begin(ctx context.Context) (string, Flow, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", Flow{}, err
+	}
+	state, err := random()
+	if err != nil {
+		return "", Flow{}, err
+	}
+	nonce, err := random()
+	if err != nil {
+		return "", Flow{}, err
+	}
+	flow := Flow{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+	authURL := config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(flow.Verifier))
+	return authURL, flow, nil
+}
+
+// Finish checks the query of the provider's callback against flow,
+// redeems its code and returns the verified email of the user.
+func (p *Provider) Finish(ctx context.Context, flow Flow, query url.Values) (string, error) {
+	config, verifier, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	if reason := query.Get("error"); reason != "" {
+		return "", fmt.Errorf("%w: %s %s", ErrDenied, reason, query.Get("error_description"))
+	}
+	if !equal(query.Get("state"), flow.State) {
+		return "", fmt.Errorf("%w: wrong state", ErrMismatch)
+	}
+
+	token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return "", fmt.Errorf("redeeming code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("token response has no ID token")
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", err
+	}
+	if !equal(idToken.Nonce, flow.Nonce) {
+		return "", fmt.Errorf("%w: wrong nonce", ErrMismatch)
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", fmt.Errorf("%w: %q", ErrUnverifiedEmail, claims.Email)
+	}
+	return claims.Email, nil
+}
+
+func equal(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
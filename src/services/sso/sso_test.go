@@ -0,0 +1,241 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	clientID    = "rechenschaftspflicht"
+	redirectURL = "https://app.example.com/login/oidc/callback"
+)
+
+// mockProvider is a minimal OpenID Connect provider that authenticates
+// everyone as email.
+type mockProvider struct {
+	*httptest.Server
+	t             *testing.T
+	key           *rsa.PrivateKey
+	email         string
+	emailVerified bool
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{t: t, key: key, email: "user@example.com", emailVerified: true, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *mockProvider) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		m.t.Error(err)
+	}
+}
+
+func (m *mockProvider) discovery(w http.ResponseWriter, _ *http.Request) {
+	m.writeJSON(w, map[string]any{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockProvider) jwks(w http.ResponseWriter, _ *http.Request) {
+	m.writeJSON(w, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test",
+		"alg": "RS256",
+		"use": "sig",
+		"n":   b64(m.key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(m.key.E)).Bytes()),
+	}}})
+}
+
+// authorize logs the user in straight away and redirects back with a code.
+func (m *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != clientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	code := b64([]byte(query.Get("state")))
+	m.mu.Lock()
+	m.codes[code] = query
+	m.mu.Unlock()
+
+	callback := url.Values{"code": {code}, "state": {query.Get("state")}}
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+callback.Encode(), http.StatusFound)
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	authorization, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || b64(challenge[:]) != authorization.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		m.writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.URL,
+		"sub":            "user-1",
+		"aud":            clientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          authorization.Get("nonce"),
+		"email":          m.email,
+		"email_verified": m.emailVerified,
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.writeJSON(w, map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+// callback follows authURL like a browser would and returns the query the
+// provider redirects back with.
+func callback(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("expected redirect back, got %d: %v", resp.StatusCode, err)
+	}
+	return location.Query()
+}
+
+func begin(t *testing.T, p *Provider) (string, Flow) {
+	t.Helper()
+	authURL, flow, err := p.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return authURL, flow
+}
+
+func TestLogin(t *testing.T) {
+	mock := newMockProvider(t)
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	authURL, flow := begin(t, p)
+	flow, err := ParseFlow(flow.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	email, err := p.Finish(context.Background(), flow, callback(t, authURL))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if email != "user@example.com" {
+		t.Errorf("expected user@example.com, got %q", email)
+	}
+}
+
+func TestLoginRejectsCallbackForAnotherFlow(t *testing.T) {
+	mock := newMockProvider(t)
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	authURL, _ := begin(t, p)
+	_, other := begin(t, p)
+	if _, err := p.Finish(context.Background(), other, callback(t, authURL)); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected %v, got %v", ErrMismatch, err)
+	}
+}
+
+func TestLoginRejectsWrongNonce(t *testing.T) {
+	mock := newMockProvider(t)
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	authURL, flow := begin(t, p)
+	flow.Nonce = "other"
+	if _, err := p.Finish(context.Background(), flow, callback(t, authURL)); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected %v, got %v", ErrMismatch, err)
+	}
+}
+
+func TestLoginRequiresPKCEVerifier(t *testing.T) {
+	mock := newMockProvider(t)
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	authURL, flow := begin(t, p)
+	_, other := begin(t, p)
+	flow.Verifier = other.Verifier
+	if _, err := p.Finish(context.Background(), flow, callback(t, authURL)); err == nil {
+		t.Error("expected code redemption with the wrong verifier to fail")
+	}
+}
+
+func TestLoginRequiresVerifiedEmail(t *testing.T) {
+	mock := newMockProvider(t)
+	mock.emailVerified = false
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	authURL, flow := begin(t, p)
+	if _, err := p.Finish(context.Background(), flow, callback(t, authURL)); !errors.Is(err, ErrUnverifiedEmail) {
+		t.Errorf("expected %v, got %v", ErrUnverifiedEmail, err)
+	}
+}
+
+func TestLoginDeniedByProvider(t *testing.T) {
+	mock := newMockProvider(t)
+	p := New("Mock", mock.URL, clientID, "secret", redirectURL)
+
+	_, flow := begin(t, p)
+	query := url.Values{"error": {"access_denied"}, "state": {flow.State}}
+	if _, err := p.Finish(context.Background(), flow, query); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected %v, got %v", ErrDenied, err)
+	}
+}
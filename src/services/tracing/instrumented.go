@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/erkannt/rechenschaftspflicht/services/authentication"
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The decorators below wrap store queries and outgoing emails in spans,
+// joining the trace of the request that caused them.
+
+type tracedEventStore struct {
+	eventstore.EventStore
+}
+
+func TraceEventStore(store eventstore.EventStore) eventstore.EventStore {
+	return &tracedEventStore{EventStore: store}
+}
+
+func (s *tracedEventStore) Record(ctx context.Context, event eventstore.Event) (err error) {
+	ctx, span := startQuery(ctx, "events", "record")
+	defer func() { end(span, err) }()
+	return s.EventStore.Record(ctx, event)
+}
+
+func (s *tracedEventStore) GetAll(ctx context.Context) (events []eventstore.Event, err error) {
+	ctx, span := startQuery(ctx, "events", "get_all")
+	defer func() { end(span, err) }()
+	return s.EventStore.GetAll(ctx)
+}
+
+func (s *tracedEventStore) Find(ctx context.Context, filter eventstore.Filter) (events []eventstore.Event, err error) {
+	ctx, span := startQuery(ctx, "events", "find")
+	defer func() { end(span, err) }()
+	return s.EventStore.Find(ctx, filter)
+}
+
+func (s *tracedEventStore) Each(ctx context.Context, filter eventstore.Filter, fn func(eventstore.Event) error) (err error) {
+	ctx, span := startQuery(ctx, "events", "each")
+	defer func() { end(span, err) }()
+	return s.EventStore.Each(ctx, filter, fn)
+}
+
+func (s *tracedEventStore) Stats(ctx context.Context) (stats []eventstore.TagStats, err error) {
+	ctx, span := startQuery(ctx, "events", "stats")
+	defer func() { end(span, err) }()
+	return s.EventStore.Stats(ctx)
+}
+
+type tracedUserStore struct {
+	userstore.UserStore
+}
+
+func TraceUserStore(store userstore.UserStore) userstore.UserStore {
+	return &tracedUserStore{UserStore: store}
+}
+
+func (s *tracedUserStore) IsUser(ctx context.Context, email string) (exists bool, err error) {
+	ctx, span := startQuery(ctx, "users", "is_user")
+	defer func() { end(span, err) }()
+	return s.UserStore.IsUser(ctx, email)
+}
+
+func (s *tracedUserStore) AddUser(ctx context.Context, email string, username string) (err error) {
+	ctx, span := startQuery(ctx, "users", "add_user")
+	defer func() { end(span, err) }()
+	return s.UserStore.AddUser(ctx, email, username)
+}
+
+func (s *tracedUserStore) Roles(ctx context.Context, email string) (roles []string, err error) {
+	ctx, span := startQuery(ctx, "users", "roles")
+	defer func() { end(span, err) }()
+	return s.UserStore.Roles(ctx, email)
+}
+
+func (s *tracedUserStore) SetRoles(ctx context.Context, email string, roles []string) (err error) {
+	ctx, span := startQuery(ctx, "users", "set_roles")
+	defer func() { end(span, err) }()
+	return s.UserStore.SetRoles(ctx, email, roles)
+}
+
+type tracedAuth struct {
+	authentication.Auth
+}
+
+func TraceAuth(auth authentication.Auth) authentication.Auth {
+	return &tracedAuth{Auth: auth}
+}
+
+func (a *tracedAuth) SendMagicLink(ctx context.Context, toEmail, token, code string) (err error) {
+	ctx, span := tracer().Start(ctx, "smtp.send_magic_link", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { end(span, err) }()
+	return a.Auth.SendMagicLink(ctx, toEmail, token, code)
+}
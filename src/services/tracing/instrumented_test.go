@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/erkannt/rechenschaftspflicht/services/eventstore"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+type failingEventStore struct {
+	eventstore.EventStore
+}
+
+func (failingEventStore) Stats(context.Context) ([]eventstore.TagStats, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestTraceEventStoreRecordsQuerySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	if _, err := TraceEventStore(failingEventStore{}).Stats(ctx); err == nil {
+		t.Fatal("expected the store's error to be passed on")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected two spans, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "events.stats" {
+		t.Errorf("expected span events.stats, got %q", span.Name())
+	}
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected query span to join the request's trace")
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("expected error status, got %v", span.Status())
+	}
+
+	attrs := map[string]string{}
+	for _, attr := range span.Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs[string(semconv.DBCollectionNameKey)] != "events" || attrs[string(semconv.DBOperationNameKey)] != "stats" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
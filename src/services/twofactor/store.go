@@ -0,0 +1,181 @@
+package twofactor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for users without a TOTP secret or
+	// enrolment in progress, and for unknown or used recovery codes.
+	ErrNotFound = errors.New("not found")
+	// ErrReplayed is returned for a TOTP code whose time step was used
+	// already.
+	ErrReplayed = errors.New("code used already")
+)
+
+// TwoFactorStore persists users' TOTP secrets and recovery codes.
+// Recovery codes are only ever stored hashed.
+type TwoFactorStore interface {
+	// SetPending keeps secret for the user until they confirm it. It
+	// doesn't affect a secret they confirmed earlier.
+	SetPending(ctx context.Context, email, secret string) error
+	Pending(ctx context.Context, email string) (string, error)
+	// Confirm makes the pending secret the user's secret, provided it is
+	// still secret, marks step as used and replaces the user's recovery
+	// codes.
+	Confirm(ctx context.Context, email, secret string, step int64, recoveryCodeHashes []string) error
+	Secret(ctx context.Context, email string) (string, error)
+	// UseStep records that a code for the time step was used. It fails
+	// with ErrReplayed unless step is later than any used before.
+	UseStep(ctx context.Context, email string, step int64) error
+	// UseRecoveryCode marks the code with the hash as used, failing with
+	// ErrNotFound if there is no such unused code.
+	UseRecoveryCode(ctx context.Context, email, codeHash string) error
+	RecoveryCodesLeft(ctx context.Context, email string) (int, error)
+	// Disable removes the user's secret and recovery codes.
+	Disable(ctx context.Context, email string) error
+}
+
+type SQLiteTwoFactorStore struct {
+	db *sql.DB
+}
+
+func NewTwoFactorStore(db *sql.DB) TwoFactorStore {
+	return &SQLiteTwoFactorStore{db: db}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (s *SQLiteTwoFactorStore) SetPending(ctx context.Context, email, secret string) error {
+	const query = `
+		INSERT INTO totp (email, pendingSecret) VALUES (LOWER(?), ?)
+		ON CONFLICT (email) DO UPDATE SET pendingSecret = excluded.pendingSecret;
+	`
+	_, err := s.db.ExecContext(ctx, query, email, secret)
+	return err
+}
+
+func (s *SQLiteTwoFactorStore) Pending(ctx context.Context, email string) (string, error) {
+	var secret sql.NullString
+	const query = `SELECT pendingSecret FROM totp WHERE email = LOWER(?);`
+	err := s.db.QueryRowContext(ctx, query, email).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !secret.Valid) {
+		return "", ErrNotFound
+	}
+	return secret.String, err
+}
+
+func (s *SQLiteTwoFactorStore) Confirm(ctx context.Context, email, secret string, step int64, recoveryCodeHashes []string) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	const confirm = `
+		UPDATE totp
+		SET secret = pendingSecret, pendingSecret = NULL, enrolledAt = ?, lastStep = ?
+		WHERE email = LOWER(?) AND pendingSecret = ?;
+	`
+	res, err := tx.ExecContext(ctx, confirm, timestamp(time.Now()), step, email, secret)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE email = LOWER(?);`, email); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		const insert = `INSERT INTO recovery_codes (email, codeHash) VALUES (LOWER(?), ?);`
+		if _, err = tx.ExecContext(ctx, insert, email, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteTwoFactorStore) Secret(ctx context.Context, email string) (string, error) {
+	var secret sql.NullString
+	const query = `SELECT secret FROM totp WHERE email = LOWER(?);`
+	err := s.db.QueryRowContext(ctx, query, email).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !secret.Valid) {
+		return "", ErrNotFound
+	}
+	return secret.String, err
+}
+
+func (s *SQLiteTwoFactorStore) UseStep(ctx context.Context, email string, step int64) error {
+	// A single statement, so two requests can't both use the same step.
+	const query = `
+		UPDATE totp SET lastStep = ?
+		WHERE email = LOWER(?) AND secret IS NOT NULL AND (lastStep IS NULL OR lastStep < ?);
+	`
+	res, err := s.db.ExecContext(ctx, query, step, email, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrReplayed
+	}
+	return nil
+}
+
+func (s *SQLiteTwoFactorStore) UseRecoveryCode(ctx context.Context, email, codeHash string) error {
+	const query = `
+		UPDATE recovery_codes SET usedAt = ?
+		WHERE email = LOWER(?) AND codeHash = ? AND usedAt IS NULL;
+	`
+	res, err := s.db.ExecContext(ctx, query, timestamp(time.Now()), email, codeHash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteTwoFactorStore) RecoveryCodesLeft(ctx context.Context, email string) (int, error) {
+	var count int
+	const query = `SELECT COUNT(1) FROM recovery_codes WHERE email = LOWER(?) AND usedAt IS NULL;`
+	err := s.db.QueryRowContext(ctx, query, email).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteTwoFactorStore) Disable(ctx context.Context, email string) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM totp WHERE email = LOWER(?);`, email); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE email = LOWER(?);`, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
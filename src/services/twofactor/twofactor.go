@@ -0,0 +1,257 @@
+// Package twofactor adds a TOTP step to logging in, for users who enrolled
+// an authenticator app and for users whose role requires one. Recovery
+// codes stand in for the app if it is lost.
+package twofactor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"image/png"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	period            = 30
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrWrongCode is returned for codes that are neither the current TOTP
+	// code nor an unused recovery code.
+	ErrWrongCode = errors.New("wrong code")
+	// ErrRequired is returned when disabling TOTP for a user whose role
+	// requires it.
+	ErrRequired = errors.New("second factor required by role")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Service struct {
+	issuer        string
+	store         TwoFactorStore
+	users         userstore.UserStore
+	requiredRoles []string
+	now           func() time.Time
+}
+
+// New returns the service naming itself issuer in authenticator apps.
+// Users with any of requiredRoles must use a second factor.
+func New(issuer string, store TwoFactorStore, users userstore.UserStore, requiredRoles []string) *Service {
+	return &Service{
+		issuer:        issuer,
+		store:         store,
+		users:         users,
+		requiredRoles: requiredRoles,
+		now:           time.Now,
+	}
+}
+
+// Status describes a user's second factor.
+type Status struct {
+	Enrolled bool
+	// RequiredByRole means the user may not go without a second factor.
+	RequiredByRole    bool
+	RecoveryCodesLeft int
+}
+
+// Required reports whether logging in as the user needs a second factor.
+func (st Status) Required() bool {
+	return st.Enrolled || st.RequiredByRole
+}
+
+func (s *Service) Status(ctx context.Context, email string) (Status, error) {
+	var st Status
+	_, err := s.store.Secret(ctx, email)
+	switch {
+	case err == nil:
+		st.Enrolled = true
+	case !errors.Is(err, ErrNotFound):
+		return Status{}, err
+	}
+
+	roles, err := s.users.Roles(ctx, email)
+	if err != nil {
+		return Status{}, err
+	}
+	st.RequiredByRole = slices.ContainsFunc(roles, func(role string) bool {
+		return slices.Contains(s.requiredRoles, role)
+	})
+
+	if st.Enrolled {
+		if st.RecoveryCodesLeft, err = s.store.RecoveryCodesLeft(ctx, email); err != nil {
+			return Status{}, err
+		}
+	}
+	return st, nil
+}
+
+func (s *Service) key(email, secret string) (*otp.Key, error) {
+	raw, err := encoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	return totp.Generate(totp.GenerateOpts{Issuer: s.issuer, AccountName: email, Secret: raw})
+}
+
+// BeginEnrolment generates a secret for the user to add to their
+// authenticator app and returns it. It takes effect once confirmed.
+func (s *Service) BeginEnrolment(ctx context.Context, email string) (string, error) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.issuer, AccountName: email})
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.SetPending(ctx, email, key.Secret()); err != nil {
+		return "", err
+	}
+	return key.Secret(), nil
+}
+
+// PendingSecret returns the secret from BeginEnrolment until it is
+// confirmed.
+func (s *Service) PendingSecret(ctx context.Context, email string) (string, error) {
+	return s.store.Pending(ctx, email)
+}
+
+// EnrolmentQR returns a PNG of the QR code for the pending secret.
+func (s *Service) EnrolmentQR(ctx context.Context, email string) ([]byte, error) {
+	secret, err := s.store.Pending(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.key(email, secret)
+	if err != nil {
+		return nil, err
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConfirmEnrolment makes the pending secret the user's second factor if
+// code was generated from it, replacing any earlier one. It returns fresh
+// recovery codes, which are not retrievable later.
+func (s *Service) ConfirmEnrolment(ctx context.Context, email, code string) ([]string, error) {
+	secret, err := s.store.Pending(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := s.match(secret, code)
+	if !ok {
+		return nil, ErrWrongCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := s.store.Confirm(ctx, email, secret, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks code, either from the user's authenticator app or one of
+// their recovery codes, and reports whether it was a recovery code. Each
+// code works only once.
+func (s *Service) Verify(ctx context.Context, email, code string) (bool, error) {
+	code = normalize(code)
+	if len(code) != int(otp.DigitsSix) {
+		err := s.store.UseRecoveryCode(ctx, email, hashRecoveryCode(code))
+		if errors.Is(err, ErrNotFound) {
+			return true, ErrWrongCode
+		}
+		return true, err
+	}
+
+	secret, err := s.store.Secret(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	step, ok := s.match(secret, code)
+	if !ok {
+		return false, ErrWrongCode
+	}
+	return false, s.store.UseStep(ctx, email, step)
+}
+
+// match returns the time step code was generated for, allowing for the
+// clocks being one step apart.
+func (s *Service) match(secret, code string) (int64, bool) {
+	code = normalize(code)
+	now := s.now()
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*period) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, totp.ValidateOpts{
+			Period:    period,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / period, true
+		}
+	}
+	return 0, false
+}
+
+// Disable removes the user's second factor, unless their role requires
+// one.
+func (s *Service) Disable(ctx context.Context, email string) error {
+	st, err := s.Status(ctx, email)
+	if err != nil {
+		return err
+	}
+	if st.RequiredByRole {
+		return ErrRequired
+	}
+	return s.store.Disable(ctx, email)
+}
+
+// newRecoveryCode returns a code like "abcd-efgh" with 40 bits of entropy.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(encoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// normalize forgives case, spaces and dashes in entered codes.
+func normalize(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalize(code)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,211 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/erkannt/rechenschaftspflicht/services/userstore"
+	"github.com/pquerna/otp/totp"
+)
+
+type memoryStore struct {
+	pending  map[string]string
+	secrets  map[string]string
+	lastStep map[string]int64
+	codes    map[string][]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		pending:  map[string]string{},
+		secrets:  map[string]string{},
+		lastStep: map[string]int64{},
+		codes:    map[string][]string{},
+	}
+}
+
+func (m *memoryStore) SetPending(_ context.Context, email, secret string) error {
+	m.pending[email] = secret
+	return nil
+}
+
+func (m *memoryStore) Pending(_ context.Context, email string) (string, error) {
+	if secret, ok := m.pending[email]; ok {
+		return secret, nil
+	}
+	return "", ErrNotFound
+}
+
+func (m *memoryStore) Confirm(_ context.Context, email, secret string, step int64, hashes []string) error {
+	if m.pending[email] != secret {
+		return ErrNotFound
+	}
+	delete(m.pending, email)
+	m.secrets[email] = secret
+	m.lastStep[email] = step
+	m.codes[email] = hashes
+	return nil
+}
+
+func (m *memoryStore) Secret(_ context.Context, email string) (string, error) {
+	if secret, ok := m.secrets[email]; ok {
+		return secret, nil
+	}
+	return "", ErrNotFound
+}
+
+func (m *memoryStore) UseStep(_ context.Context, email string, step int64) error {
+	if step <= m.lastStep[email] {
+		return ErrReplayed
+	}
+	m.lastStep[email] = step
+	return nil
+}
+
+func (m *memoryStore) UseRecoveryCode(_ context.Context, email, hash string) error {
+	i := slices.Index(m.codes[email], hash)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.codes[email] = slices.Delete(m.codes[email], i, i+1)
+	return nil
+}
+
+func (m *memoryStore) RecoveryCodesLeft(_ context.Context, email string) (int, error) {
+	return len(m.codes[email]), nil
+}
+
+func (m *memoryStore) Disable(_ context.Context, email string) error {
+	delete(m.secrets, email)
+	delete(m.codes, email)
+	return nil
+}
+
+type memoryUsers struct {
+	userstore.UserStore
+	roles map[string][]string
+}
+
+func (u memoryUsers) Roles(_ context.Context, email string) ([]string, error) {
+	return u.roles[email], nil
+}
+
+const email = "admin@example.com"
+
+func newTestService(now *time.Time) *Service {
+	users := memoryUsers{roles: map[string][]string{email: {userstore.RoleAdmin}}}
+	s := New("Test", newMemoryStore(), users, []string{userstore.RoleAdmin})
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func code(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	c, err := totp.GenerateCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// enrol returns the user's secret and recovery codes.
+func enrol(t *testing.T, s *Service, now time.Time) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+	secret, err := s.BeginEnrolment(ctx, email)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.ConfirmEnrolment(ctx, email, code(t, secret, now.Add(-10*period*time.Second))); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("expected %v for an old code, got %v", ErrWrongCode, err)
+	}
+	codes, err := s.ConfirmEnrolment(ctx, email, code(t, secret, now))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return secret, codes
+}
+
+func TestEnrolAndVerify(t *testing.T) {
+	now := time.Now()
+	s := newTestService(&now)
+	ctx := context.Background()
+
+	st, err := s.Status(ctx, email)
+	if err != nil || st.Enrolled || !st.Required() {
+		t.Fatalf("expected a required but not enrolled second factor, got %+v, %v", st, err)
+	}
+
+	secret, codes := enrol(t, s, now)
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	// The code used to confirm enrolment is spent.
+	if _, err := s.Verify(ctx, email, code(t, secret, now)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected %v, got %v", ErrReplayed, err)
+	}
+
+	now = now.Add(period * time.Second)
+	if _, err := s.Verify(ctx, email, code(t, secret, now)); err != nil {
+		t.Errorf("expected the next code to work, got %v", err)
+	}
+	if _, err := s.Verify(ctx, email, code(t, secret, now)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected %v for a reused code, got %v", ErrReplayed, err)
+	}
+}
+
+func TestVerifyAllowsOneStepOfClockSkew(t *testing.T) {
+	now := time.Now()
+	s := newTestService(&now)
+	secret, _ := enrol(t, s, now)
+	now = now.Add(10 * period * time.Second)
+
+	if _, err := s.Verify(context.Background(), email, code(t, secret, now.Add(-period*time.Second))); err != nil {
+		t.Errorf("expected the previous code to work, got %v", err)
+	}
+	if _, err := s.Verify(context.Background(), email, code(t, secret, now.Add(3*period*time.Second))); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("expected %v for a code from the future, got %v", ErrWrongCode, err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	now := time.Now()
+	s := newTestService(&now)
+	ctx := context.Background()
+	_, codes := enrol(t, s, now)
+
+	recovery, err := s.Verify(ctx, email, " "+codes[3]+" ")
+	if err != nil || !recovery {
+		t.Fatalf("expected recovery code to work, got %v, %v", recovery, err)
+	}
+	if _, err := s.Verify(ctx, email, codes[3]); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("expected %v for a used recovery code, got %v", ErrWrongCode, err)
+	}
+
+	st, _ := s.Status(ctx, email)
+	if st.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, st.RecoveryCodesLeft)
+	}
+}
+
+func TestDisableRespectsRequiredRoles(t *testing.T) {
+	now := time.Now()
+	s := newTestService(&now)
+	enrol(t, s, now)
+
+	if err := s.Disable(context.Background(), email); !errors.Is(err, ErrRequired) {
+		t.Errorf("expected %v, got %v", ErrRequired, err)
+	}
+
+	s.requiredRoles = nil
+	if err := s.Disable(context.Background(), email); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st, _ := s.Status(context.Background(), email); st.Required() {
+		t.Errorf("expected no second factor after disabling, got %+v", st)
+	}
+}
@@ -1,14 +1,24 @@
 package userstore
 
 import (
+	"context"
 	"database/sql"
 )
 
 type UserStore interface {
-	IsUser(email string) (bool, error)
-	AddUser(email string, username string) error
+	IsUser(ctx context.Context, email string) (bool, error)
+	AddUser(ctx context.Context, email string, username string) error
+	// Roles returns the user's roles, such as RoleAdmin.
+	Roles(ctx context.Context, email string) ([]string, error)
+	// SetRoles replaces the user's roles.
+	SetRoles(ctx context.Context, email string, roles []string) error
 }
 
+// RoleAdmin is the role of users who administer the instance.
+const RoleAdmin = "admin"
+
+var KnownRoles = []string{RoleAdmin}
+
 type SQLiteUserStore struct {
 	db *sql.DB
 }
@@ -17,7 +27,7 @@ func NewUserStore(db *sql.DB) UserStore {
 	return &SQLiteUserStore{db: db}
 }
 
-func (s *SQLiteUserStore) IsUser(email string) (bool, error) {
+func (s *SQLiteUserStore) IsUser(ctx context.Context, email string) (bool, error) {
 	const query = `
 		SELECT COUNT(1)
 		FROM users
@@ -25,18 +35,69 @@ func (s *SQLiteUserStore) IsUser(email string) (bool, error) {
 	`
 
 	var count int
-	if err := s.db.QueryRow(query, email).Scan(&count); err != nil {
+	if err := s.db.QueryRowContext(ctx, query, email).Scan(&count); err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (s *SQLiteUserStore) AddUser(email string, username string) error {
+func (s *SQLiteUserStore) AddUser(ctx context.Context, email string, username string) error {
 	const query = `
 		INSERT INTO users (email, username)
 		VALUES (LOWER(?), ?);
 	`
 
-	_, err := s.db.Exec(query, email, username)
+	_, err := s.db.ExecContext(ctx, query, email, username)
 	return err
 }
+
+func (s *SQLiteUserStore) Roles(ctx context.Context, email string) (roles []string, err error) {
+	const query = `
+		SELECT role
+		FROM user_roles
+		WHERE email = LOWER(?)
+		ORDER BY role;
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *SQLiteUserStore) SetRoles(ctx context.Context, email string, roles []string) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM user_roles WHERE email = LOWER(?);`, email); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		const insert = `INSERT OR IGNORE INTO user_roles (email, role) VALUES (LOWER(?), ?);`
+		if _, err = tx.ExecContext(ctx, insert, email, role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}